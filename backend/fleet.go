@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/mayank447/videosync/settings"
+)
+
+// StreamingServerStatus is what a streaming server reports on its /status endpoint
+type StreamingServerStatus struct {
+	ID            string         `json:"id"`
+	URL           string         `json:"url"`
+	Capacity      int            `json:"capacity"`
+	CurrentLoad   int            `json:"currentLoad"`
+	Status        string         `json:"status"` // active or draining
+	StartedAt     string         `json:"startedAt"`
+	UptimeSeconds int64          `json:"uptimeSeconds"`
+	Redis         string         `json:"redis"`    // "ok" or the error reaching Redis
+	Sessions      map[string]int `json:"sessions"` // local clients per session
+
+	// Stall reports per session, see the streaming server's bufferingReport
+	Buffering map[string]struct {
+		Stalls         int64   `json:"stalls"`
+		StalledViewers int     `json:"stalledViewers"`
+		Viewers        int     `json:"viewers"`
+		MinBufferLevel float64 `json:"minBufferLevel"`
+	} `json:"buffering,omitempty"`
+}
+
+// fleetServer is one entry of GET /api/streaming-servers: the registry entry
+// and, when the server answered, its own status report
+type fleetServer struct {
+	*StreamingServer
+	LoadRatio float64                `json:"loadRatio"`
+	Reachable bool                   `json:"reachable"`
+	Live      *StreamingServerStatus `json:"live,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+}
+
+// listStreamingServers returns every registered streaming server along with
+// the live status each one reports, polled in parallel
+func listStreamingServers(w http.ResponseWriter, r *http.Request) {
+	ids, err := rdb.ZRange(ctx, streamingServerLoadKey, 0, -1).Result()
+	if err != nil {
+		settings.Logger(r.Context()).Error("Redis error listing streaming servers", "error", err)
+		respondError(w, http.StatusInternalServerError, "internal_server_error")
+		return
+	}
+
+	servers := make([]*fleetServer, 0, len(ids))
+	for _, id := range ids {
+		server, err := getStreamingServer(id)
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			settings.Logger(r.Context()).Error("Redis error getting streaming server", "server_id", id, "error", err)
+			continue
+		}
+		servers = append(servers, &fleetServer{StreamingServer: server, LoadRatio: loadRatio(server)})
+	}
+
+	var wg sync.WaitGroup
+	for _, entry := range servers {
+		wg.Add(1)
+		go func(entry *fleetServer) {
+			defer wg.Done()
+			live, err := fetchServerStatus(r.Context(), entry.StreamingServer)
+			if err != nil {
+				entry.Error = err.Error()
+				return
+			}
+			entry.Reachable = true
+			entry.Live = live
+		}(entry)
+	}
+	wg.Wait()
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"servers": servers,
+		"count":   len(servers),
+	})
+}
+
+// fetchServerStatus asks a streaming server for its /status report
+func fetchServerStatus(parent context.Context, server *StreamingServer) (*StreamingServerStatus, error) {
+	statusCtx, cancel := context.WithTimeout(parent, healthCheckTimeout)
+	defer cancel()
+
+	url := server.URL
+	if !strings.HasPrefix(url, "http") {
+		url = "http://" + url
+	}
+	req, err := http.NewRequestWithContext(statusCtx, http.MethodGet, strings.TrimSuffix(url, "/")+"/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	if id := settings.RequestIDFrom(parent); id != "" {
+		req.Header.Set(settings.RequestIDHeader, id)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status endpoint responded %s", resp.Status)
+	}
+
+	var status StreamingServerStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// Consistent hashing places every streaming server on a ring at several
+// points (virtual nodes) and maps a session to the first server point at or
+// after the session key's hash. A session keeps its server while the server
+// set is stable, and a server joining or leaving only moves the sessions
+// next to its points.
+
+const virtualNodesPerServer = 100
+
+type hashRing struct {
+	points  []uint32 // sorted
+	servers map[uint32]*StreamingServer
+}
+
+func newHashRing(servers []*StreamingServer) *hashRing {
+	ring := &hashRing{servers: make(map[uint32]*StreamingServer)}
+	for _, server := range servers {
+		for i := 0; i < virtualNodesPerServer; i++ {
+			point := hashKey(server.ID + "#" + strconv.Itoa(i))
+			if _, taken := ring.servers[point]; taken {
+				continue
+			}
+			ring.servers[point] = server
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// get returns the first server clockwise from key that accept reports as
+// usable, or nil if there is none
+func (ring *hashRing) get(key string, accept func(*StreamingServer) bool) *StreamingServer {
+	if len(ring.points) == 0 {
+		return nil
+	}
+
+	start := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= hashKey(key) })
+	tried := make(map[string]bool)
+	for i := 0; i < len(ring.points); i++ {
+		server := ring.servers[ring.points[(start+i)%len(ring.points)]]
+		if tried[server.ID] {
+			continue
+		}
+		tried[server.ID] = true
+		if accept(server) {
+			return server
+		}
+	}
+	return nil
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
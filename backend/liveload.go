@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Heartbeats only refresh a streaming server's load every 30 seconds, so a
+// burst of new sessions all land on the server that looked idle at its last
+// heartbeat. With live load checks on, server selection asks the candidates'
+// /status endpoints for their current load instead. Answers are cached
+// briefly per main server instance, and a server whose endpoint keeps failing
+// is left out of selection until it is probed again.
+
+// liveLoad is the last /status answer of one streaming server
+type liveLoad struct {
+	load        int
+	status      string // active or draining
+	fetchedAt   time.Time
+	failures    int // consecutive failed status calls
+	lastFailure time.Time
+}
+
+var (
+	liveLoads      = make(map[string]*liveLoad)
+	liveLoadsMutex = &sync.Mutex{}
+)
+
+// currentLoad returns the load to select a server by, and whether the server
+// may be selected at all. Without live checks it is the heartbeat value. A
+// failed status call falls back to the heartbeat value until the server has
+// failed maxLiveLoadFailures times in a row, then the server is unhealthy
+// until it answers again, which is tried every unhealthyRetryInterval.
+func currentLoad(server *StreamingServer) (int, bool) {
+	if !liveLoadCheck {
+		return server.CurrentLoad, true
+	}
+
+	liveLoadsMutex.Lock()
+	entry, ok := liveLoads[server.ID]
+	if !ok {
+		entry = &liveLoad{}
+		liveLoads[server.ID] = entry
+	}
+	switch {
+	case entry.failures >= maxLiveLoadFailures && time.Since(entry.lastFailure) < unhealthyRetryInterval:
+		liveLoadsMutex.Unlock()
+		return server.CurrentLoad, false
+	case entry.failures == 0 && time.Since(entry.fetchedAt) < liveLoadCacheTTL:
+		load, status := entry.load, entry.status
+		liveLoadsMutex.Unlock()
+		return load, status == "active"
+	}
+	liveLoadsMutex.Unlock()
+
+	statusCtx, cancel := context.WithTimeout(ctx, liveLoadTimeout)
+	defer cancel()
+	live, err := fetchServerStatus(statusCtx, server)
+
+	liveLoadsMutex.Lock()
+	defer liveLoadsMutex.Unlock()
+	if err != nil {
+		entry.failures++
+		entry.lastFailure = time.Now()
+		if entry.failures < maxLiveLoadFailures {
+			return server.CurrentLoad, true
+		}
+		if entry.failures == maxLiveLoadFailures {
+			slog.Warn("Streaming server failed status checks, excluding it from selection", "server_id", server.ID, "failures", entry.failures, "error", err)
+		}
+		return server.CurrentLoad, false
+	}
+	if entry.failures >= maxLiveLoadFailures {
+		slog.Info("Streaming server is answering status checks again", "server_id", server.ID)
+	}
+	entry.load = live.CurrentLoad
+	entry.status = live.Status
+	entry.fetchedAt = time.Now()
+	entry.failures = 0
+	return entry.load, entry.status == "active"
+}
+
+// currentLoadRatio is loadRatio with the live load, and whether the server
+// may be selected
+func currentLoadRatio(server *StreamingServer) (float64, bool) {
+	load, ok := currentLoad(server)
+	if server.Capacity <= 0 {
+		return 1.0, ok
+	}
+	return float64(load) / float64(server.Capacity), ok
+}
+
+// pickLiveLeastLoaded checks the live load of every candidate in parallel and
+// returns the least loaded healthy one with room left, or nil
+func pickLiveLeastLoaded(candidates []*StreamingServer) *StreamingServer {
+	ratios := make([]float64, len(candidates))
+	healthy := make([]bool, len(candidates))
+	var wg sync.WaitGroup
+	for i, server := range candidates {
+		wg.Add(1)
+		go func(i int, server *StreamingServer) {
+			defer wg.Done()
+			ratios[i], healthy[i] = currentLoadRatio(server)
+		}(i, server)
+	}
+	wg.Wait()
+
+	var best *StreamingServer
+	bestRatio := 1.0
+	for i, server := range candidates {
+		if healthy[i] && ratios[i] < bestRatio {
+			best, bestRatio = server, ratios[i]
+		}
+	}
+	return best
+}
+
+// forgetLiveLoad drops a deregistered server's cached status
+func forgetLiveLoad(serverID string) {
+	liveLoadsMutex.Lock()
+	delete(liveLoads, serverID)
+	liveLoadsMutex.Unlock()
+}
@@ -3,26 +3,33 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"github.com/gorilla/handlers" // For CORS
 	"github.com/gorilla/mux"
+	"github.com/mayank447/videosync/settings"
+	"github.com/mayank447/videosync/store"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/bcrypt"
 )
 
-// STruct and Global Variables for Redis
-type SessionState struct {
-	Paused       bool    `json:"paused"`
-	CurrentTime  float64 `json:"currentTime"`
-	PlaybackRate float64 `json:"playbackRate"`
-	Timestamp    int64   `json:"timestamp"`
-}
-
 type Config struct {
 	StreamingServers map[string]*StreamingServer
 	mu               sync.RWMutex
@@ -31,6 +38,9 @@ type Config struct {
 var (
 	rdb    *redis.Client
 	pubsub *redis.PubSub
+
+	// Session keys in Redis, see the store package
+	sessionStore *store.SessionStore
 )
 
 // STructs and Global Variable for Streaming Server
@@ -52,13 +62,25 @@ type ServerMetrics struct {
 }
 
 var (
-	streamingServers = make(map[string]*StreamingServer)
-	serverMutex      sync.RWMutex
-	ctx              = context.Background() // Add global context
+	ctx = context.Background() // Add global context
+
+	// How a new session picks its streaming server
+	serverSelection string
+
+	// Per client IP limit on session creation
+	sessionRateLimit  int
+	sessionRateWindow time.Duration
+
+	// Check the live load of streaming servers when selecting one
+	liveLoadCheck bool
+
+	// Proxies whose X-Forwarded-For clientIP believes
+	trustedProxies []*net.IPNet
 )
 
 var (
 	sessionMutex = &sync.Mutex{}
+	metricsMutex = &sync.Mutex{}
 	metrics      = ServerMetrics{
 		Status: "starting",
 	}
@@ -67,25 +89,158 @@ var (
 // Gloabl Consts
 const (
 	sessionExpiry = time.Hour * 24
+
+	// Streaming server registry (shared between main server instances via Redis)
+	streamingServerKeyPrefix = "streaming-server:"      // hash per server, expires without heartbeats
+	streamingServerLoadKey   = "streaming-servers:load" // sorted set of load ratio per server ID
+	streamingServerTTL       = time.Minute
+
+	healthCheckTimeout = 2 * time.Second
+
+	// Live load checks on selection, see liveload.go
+	liveLoadTimeout        = 500 * time.Millisecond
+	liveLoadCacheTTL       = 2 * time.Second
+	maxLiveLoadFailures    = 3                // consecutive failures before a server is excluded
+	unhealthyRetryInterval = 30 * time.Second // how often an excluded server is probed again
+
+	// Server selection strategies
+	selectLeastLoaded    = "least-loaded"
+	selectConsistentHash = "consistent-hash"
+
+	// Session metadata limits
+	maxTitleLength   = 100
+	maxCreatorLength = 64
+
+	// Session passwords, checked by validateSession
+	maxPasswordLength     = 72 // bcrypt ignores anything longer
+	sessionPasswordHeader = "X-Session-Password"
+	joinTokenTTL          = 5 * time.Minute // how long a join token admits a WebSocket
+
+	// Retried session creations carrying the same key get the first response
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	idempotencyTTL           = 15 * time.Minute
+	maxIdempotencyKeyLength  = 255
+	idempotencyPending       = "pending" // stored while the first request is running
+
+	// Streaming servers identify themselves with this header on register/heartbeat
+	serverTokenHeader = "X-Server-Token"
+
+	// Published with the session key when a host ends a session
+	sessionEndedChannel = "session-ended"
+
+	// Published when a streaming server dies so its clients move elsewhere
+	serverReassignChannel = "server-reassign"
 )
 
+// rateLimitScript counts a request in a fixed window, returning the count so
+// far and the milliseconds left in the window
+var rateLimitScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return {count, redis.call("PTTL", KEYS[1])}
+`)
+
+// registerScript stores a server's registry entry unless another active
+// server already holds the ID. The owner can re-register by presenting the
+// token it registered with. Returns 0 on conflict, 1 on success.
+var registerScript = redis.NewScript(`
+local existing = redis.call("HMGET", KEYS[1], "status", "token")
+if existing[1] == "active" and existing[2] ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", KEYS[1])
+redis.call("HSET", KEYS[1], unpack(ARGV, 5))
+redis.call("HSET", KEYS[1], "token", ARGV[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+redis.call("ZADD", KEYS[2], ARGV[3], ARGV[4])
+return 1
+`)
+
+// heartbeatScript applies a heartbeat atomically so that concurrent or out of
+// order heartbeats from the same server can't overwrite a newer load value.
+// It is a no-op when the server's registry entry has already expired and is
+// rejected when the token doesn't match the registered one.
+// Returns 0 for an unknown server, -1 for a token mismatch, 1 otherwise.
+var heartbeatScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+if redis.call("HGET", KEYS[1], "token") ~= ARGV[7] then
+	return -1
+end
+local last = tonumber(redis.call("HGET", KEYS[1], "heartbeatAt") or "0")
+if tonumber(ARGV[1]) < last then
+	return 1
+end
+redis.call("HSET", KEYS[1], "heartbeatAt", ARGV[1], "currentLoad", ARGV[2], "lastPing", ARGV[3], "status", "active")
+redis.call("PEXPIRE", KEYS[1], ARGV[5])
+redis.call("ZADD", KEYS[2], ARGV[4], ARGV[6])
+return 1
+`)
+
+// deregisterScript removes a server's registry entry and load index member if
+// the token matches the registered one.
+// Returns 0 for an unknown server, -1 for a token mismatch, 1 otherwise.
+var deregisterScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+if redis.call("HGET", KEYS[1], "token") ~= ARGV[1] then
+	return -1
+end
+redis.call("DEL", KEYS[1])
+redis.call("ZREM", KEYS[2], ARGV[2])
+return 1
+`)
+
 func main() {
+	settings.SetupLogging("main")
+	cfg := settings.Register()
+	flag.IntVar(&sessionRateLimit, "session-rate-limit", settings.EnvInt("SESSION_RATE_LIMIT", 10),
+		"Sessions one client IP may create per window, 0 disables (env SESSION_RATE_LIMIT)")
+	flag.DurationVar(&sessionRateWindow, "session-rate-window", settings.EnvDuration("SESSION_RATE_WINDOW", time.Minute),
+		"Session creation rate limit window (env SESSION_RATE_WINDOW)")
+	flag.StringVar(&serverSelection, "server-selection", settings.EnvOr("SERVER_SELECTION", selectLeastLoaded),
+		"Streaming server selection strategy, least-loaded or consistent-hash (env SERVER_SELECTION)")
+	flag.BoolVar(&liveLoadCheck, "live-load", settings.EnvBool("LIVE_LOAD", false),
+		"Ask streaming servers for their current load when selecting one instead of trusting heartbeats (env LIVE_LOAD)")
+	flag.Parse()
+	if err := cfg.Validate(false); err != nil {
+		log.Fatal(err)
+	}
+	trustedProxies = cfg.TrustedProxies
+	if serverSelection != selectLeastLoaded && serverSelection != selectConsistentHash {
+		log.Fatalf("unknown server selection strategy %q", serverSelection)
+	}
+	if sessionRateLimit < 0 || sessionRateWindow <= 0 {
+		log.Fatal("session rate limit must not be negative and its window must be positive")
+	}
+
 	// Initialize Redis
-	rdb = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
-	})
+	rdb = cfg.NewRedisClient()
+	sessionStore = store.NewSessionStore(rdb)
+	settings.CountRedisErrors(rdb, redisErrors)
 
 	// Create router
 	r := mux.NewRouter()
 
+	// Add logging middleware, outside recovery so panics are logged with a 500
+	r.Use(settings.LogRequests)
+
 	// Add error recovery middleware
 	r.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			defer func() {
 				if err := recover(); err != nil {
-					log.Printf("Panic recovered: %v", err)
+					settings.Logger(r.Context()).Error("Panic recovered",
+						"error", fmt.Sprint(err),
+						"method", r.Method,
+						"path", r.URL.Path,
+						"stack", string(debug.Stack()),
+					)
 					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 				}
 			}()
@@ -93,17 +248,8 @@ func main() {
 		})
 	})
 
-	// Add logging middleware
-	r.Use(func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			log.Printf("Incoming connection from %s to %s %s", r.RemoteAddr, r.Method, r.URL.Path)
-			next.ServeHTTP(w, r)
-		})
-	})
-
 	// Root endpoint
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Root request from %s", r.RemoteAddr)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{
 			"message": "VideoSync API Server",
@@ -111,15 +257,24 @@ func main() {
 		})
 	}).Methods("GET")
 
+	// Health check, verifies Redis is reachable
+	r.HandleFunc("/healthz", handleHealthz).Methods("GET")
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
 	// API routes
-	r.HandleFunc("/api/sessions", createSession).Methods("POST")
+	r.Handle("/api/sessions", rateLimitSessions(http.HandlerFunc(createSession))).Methods("POST")
+	r.HandleFunc("/api/sessions", listSessions).Methods("GET")
+	r.HandleFunc("/api/sessions/{key}", deleteSession).Methods("DELETE")
 	r.HandleFunc("/api/sessions/{key}/validate", validateSession).Methods("GET")
+	r.HandleFunc("/api/sessions/{key}/manifest", getManifest).Methods("GET")
+	r.HandleFunc("/api/sessions/{key}/transfer-host", transferHost).Methods("POST")
+	r.HandleFunc("/api/streaming-servers", listStreamingServers).Methods("GET")
 	r.HandleFunc("/api/streaming-servers/register", registerStreamingServer).Methods("POST")
 	r.HandleFunc("/api/streaming-servers/heartbeat", handleHeartbeat).Methods("POST")
-	// TODO - Reassign clients
+	r.HandleFunc("/api/streaming-servers/deregister", deregisterStreamingServer).Methods("POST")
 
 	// Start server
-	log.Println("Starting server on :8080")
+	slog.Info("Starting server", "addr", ":8080", "tls", cfg.TLSEnabled())
 
 	// With CORS-enabled server (Middle ware)
 	headersOk := handlers.AllowedHeaders([]string{
@@ -128,90 +283,304 @@ func main() {
 		"Sec-WebSocket-Extensions",
 		"Sec-WebSocket-Key",
 		"Sec-WebSocket-Version",
+		"X-Host-Token",
+		"X-Owner-Token",
+		sessionPasswordHeader,
+		idempotencyKeyHeader,
+		settings.RequestIDHeader,
 	})
-	originsOk := handlers.AllowedOrigins([]string{"*"})
-	methodsOk := handlers.AllowedMethods([]string{"GET", "POST", "OPTIONS"})
-	exposedOk := handlers.ExposedHeaders([]string{"Content-Length"})
+	originsOk := handlers.AllowedOrigins(cfg.CORSOrigins())
+	methodsOk := handlers.AllowedMethods([]string{"GET", "POST", "DELETE", "OPTIONS"})
+	exposedOk := handlers.ExposedHeaders([]string{"Content-Length", idempotentReplayedHeader, settings.RequestIDHeader})
+
+	// Stop on SIGINT/SIGTERM, letting in-flight requests finish
+	stopCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Start background tasks
-	go cleanupInactiveServers()
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		cleanupInactiveServers(stopCtx)
+	}()
 
-	log.Fatal(http.ListenAndServe("0.0.0.0:8080",
-		handlers.CORS(originsOk, headersOk, methodsOk, exposedOk)(r)))
+	srv := &http.Server{
+		Addr:    "0.0.0.0:8080",
+		Handler: settings.RequestID(handlers.CORS(originsOk, headersOk, methodsOk, exposedOk)(r)),
+	}
+	go func() {
+		if err := cfg.ListenAndServe(srv); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-stopCtx.Done()
+	slog.Info("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error shutting down", "error", err)
+	}
+	background.Wait()
+	rdb.Close()
+	slog.Info("Server stopped")
 }
 
 // Session creation endpoint
 func createSession(w http.ResponseWriter, r *http.Request) {
+	// Optional metadata, an empty body creates an untitled session
+	var req struct {
+		Title    string `json:"title"`
+		Creator  string `json:"creator"`
+		Password string `json:"password"` // makes the session private
+	}
+	// Needed to add to a creator that already has sessions
+	ownerToken := r.Header.Get("X-Owner-Token")
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		respondError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	req.Title = strings.TrimSpace(req.Title)
+	req.Creator = strings.TrimSpace(req.Creator)
+	if len(req.Title) > maxTitleLength || len(req.Creator) > maxCreatorLength {
+		respondError(w, http.StatusBadRequest, "metadata_too_long")
+		return
+	}
+	if len(req.Password) > maxPasswordLength {
+		respondError(w, http.StatusBadRequest, "password_too_long")
+		return
+	}
+
+	// A retry of a request that already created a session gets that session
+	idempotencyKey, ok := claimIdempotencyKey(w, r)
+	if !ok {
+		return
+	}
+	stored := false
+	if idempotencyKey != "" {
+		defer func() {
+			// Let a retry start over when this request failed, or couldn't
+			// store a response to replay
+			if !stored {
+				rdb.Del(ctx, idempotencyKey)
+			}
+		}()
+	}
+
+	var passwordHash []byte
+	if req.Password != "" {
+		var err error
+		passwordHash, err = bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			settings.Logger(r.Context()).Error("Error hashing session password", "error", err)
+			http.Error(w, "Failed to create session", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	sessionKey := uuid.New().String()
 	hostToken := uuid.New().String()
 	ctx := context.Background()
+	logger := settings.Logger(r.Context()).With("session_id", sessionKey)
 
-	log.Printf("Creating new session - Key: %s, Host Token: %s", sessionKey, hostToken)
+	logger.Info("Creating new session", "password_protected", passwordHash != nil)
 
-	// [TODO] Check whether the sessionKey, hostToken already exists or not
+	// Index the session under its creator first, so a wrong owner token
+	// leaves nothing behind. An entry a failure below orphans is pruned
+	// when the owner lists their sessions.
+	if req.Creator != "" {
+		var err error
+		ownerToken, err = sessionStore.IndexOwnerSession(ctx, req.Creator, sessionKey, ownerToken, uuid.New().String(), sessionExpiry)
+		if err == store.ErrInvalidOwnerToken {
+			logger.Warn("Invalid owner token provided for session creation")
+			respondError(w, http.StatusForbidden, "invalid_owner_token")
+			return
+		} else if err != nil {
+			logger.Error("Redis error indexing session under its creator", "error", err)
+			http.Error(w, "Failed to create session", http.StatusInternalServerError)
+			return
+		}
+	}
 
-	// Store session
-	err := rdb.SetEX(ctx, "session:"+sessionKey, "active", sessionExpiry).Err()
+	// Store session with its host token and initial state, never reusing a live key
+	stored, err := sessionStore.CreateSession(ctx, sessionKey, hostToken, sessionExpiry)
 	if err != nil {
-		log.Printf("Redis error creating session: %v", err)
+		logger.Error("Redis error creating session", "error", err)
 		http.Error(w, "Failed to create session", http.StatusInternalServerError)
 		return
 	}
-
-	// Store host token
-	err = rdb.SetEX(ctx, "session:"+sessionKey+":host", hostToken, sessionExpiry).Err()
-	if err != nil {
-		log.Printf("Redis error storing host token: %v", err)
+	if !stored {
+		logger.Error("Generated session key already exists")
 		http.Error(w, "Failed to create session", http.StatusInternalServerError)
 		return
 	}
 
-	// Store initial state
-	initialState := SessionState{
-		Paused:       true,
-		CurrentTime:  0,
-		PlaybackRate: 1.0,
-		Timestamp:    time.Now().Unix(),
-	}
-	stateJson, _ := json.Marshal(initialState)
-	err = rdb.SetEX(ctx, "session:"+sessionKey+":state", stateJson, sessionExpiry).Err()
+	// Store metadata
+	createdAt := time.Now()
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, store.Key(sessionKey, store.Meta),
+			"title", req.Title,
+			"creator", req.Creator,
+			"createdAt", createdAt.Format(time.RFC3339),
+		)
+		pipe.Expire(ctx, store.Key(sessionKey, store.Meta), sessionExpiry)
+		if passwordHash != nil {
+			pipe.SetEX(ctx, store.Key(sessionKey, store.Password), passwordHash, sessionExpiry)
+		}
+		return nil
+	})
 	if err != nil {
-		log.Printf("Redis error storing initial state: %v", err)
+		logger.Error("Redis error storing session metadata", "error", err)
 		http.Error(w, "Failed to create session", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Session created successfully - Key: %s", sessionKey)
+	sessionsCreated.Inc()
+	logger.Info("Session created")
 
-	// Return both session key and host token
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
+	// Return both session key and host token, and the token for listing
+	// the creator's sessions
+	body := map[string]string{
 		"sessionKey": sessionKey,
 		"hostToken":  hostToken,
+	}
+	if req.Creator != "" {
+		body["ownerToken"] = ownerToken
+	}
+	response, _ := json.Marshal(body)
+	if idempotencyKey != "" {
+		if err := rdb.Set(ctx, idempotencyKey, response, idempotencyTTL).Err(); err != nil {
+			logger.Error("Redis error storing idempotent response", "error", err)
+		} else {
+			stored = true
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(response, '\n'))
+}
+
+// claimIdempotencyKey reserves the request's Idempotency-Key, returning the
+// Redis key to store the response under, or "" when the request has none.
+// When another request already holds the key it writes that request's
+// response, or a 409 while it is still running, and returns false.
+func claimIdempotencyKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	header := r.Header.Get(idempotencyKeyHeader)
+	if header == "" {
+		return "", true
+	}
+	if !validIdempotencyKey(header) {
+		respondError(w, http.StatusBadRequest, "invalid_idempotency_key")
+		return "", false
+	}
+
+	// Scoped to the client so other clients can't replay its host token
+	key := "idempotency:sessions:" + clientIP(r) + ":" + header
+	claimed, err := rdb.SetNX(ctx, key, idempotencyPending, idempotencyTTL).Result()
+	if err != nil {
+		settings.Logger(r.Context()).Error("Redis error claiming idempotency key", "error", err)
+		respondError(w, http.StatusInternalServerError, "internal_server_error")
+		return "", false
+	}
+	if claimed {
+		return key, true
+	}
+
+	response, err := rdb.Get(ctx, key).Result()
+	if err != nil && err != redis.Nil {
+		settings.Logger(r.Context()).Error("Redis error reading idempotent response", "error", err)
+		respondError(w, http.StatusInternalServerError, "internal_server_error")
+		return "", false
+	}
+	if err == redis.Nil || response == idempotencyPending {
+		// Still being created, or the first attempt just failed
+		w.Header().Set("Retry-After", "1")
+		respondError(w, http.StatusConflict, "request_in_progress")
+		return "", false
+	}
+
+	settings.Logger(r.Context()).Info("Replaying idempotent session creation")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.Write([]byte(response + "\n"))
+	return "", false
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for _, c := range key {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// rateLimitSessions limits how many sessions each client IP may create per
+// window. The count lives in Redis so it's shared by all main servers.
+func rateLimitSessions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sessionRateLimit == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := clientIP(r)
+		result, err := rateLimitScript.Run(ctx, rdb,
+			[]string{"ratelimit:sessions:" + ip},
+			sessionRateWindow.Milliseconds(),
+		).Int64Slice()
+		if err != nil {
+			// Don't lock everyone out because Redis hiccuped
+			settings.Logger(r.Context()).Error("Redis error checking rate limit", "client_ip", ip, "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if count, ttl := result[0], result[1]; count > int64(sessionRateLimit) {
+			retryAfter := int64(math.Ceil(float64(ttl) / 1000))
+			settings.Logger(r.Context()).Warn("Rate limited session creation", "client_ip", ip)
+			sessionsRateLimited.Inc()
+			w.Header().Set("Retry-After", strconv.FormatInt(max(retryAfter, 1), 10))
+			respondError(w, http.StatusTooManyRequests, "rate_limited")
+			return
+		}
+		next.ServeHTTP(w, r)
 	})
 }
 
+// clientIP returns the originating client address, taken from
+// X-Forwarded-For only when the request came through a trusted proxy
+func clientIP(r *http.Request) string {
+	return settings.ClientIP(r, trustedProxies)
+}
+
 // Session validation endpoint
 func validateSession(w http.ResponseWriter, r *http.Request) {
-	// print the request
-	log.Printf(r.URL.Path)
-	sessionKey := r.URL.Path[len("/api/sessions/"):]
-	sessionKey = strings.Split(sessionKey, "?")[0]
-	sessionKey = sessionKey[:len(sessionKey)-len("/validate")]
+	sessionKey := mux.Vars(r)["key"]
+	if !validSessionKey(sessionKey) {
+		respondError(w, http.StatusBadRequest, "invalid_session_key")
+		return
+	}
 	hostToken := r.URL.Query().Get("hostToken")
+	logger := settings.Logger(r.Context()).With("session_id", sessionKey)
 
-	log.Printf("Validating session - Key: %s, Host Token provided: %v", sessionKey, hostToken != "")
+	logger.Info("Validating session", "host_token_provided", hostToken != "")
 
 	// Check if session exists
-	exists, err := rdb.Exists(ctx, "session:"+sessionKey).Result()
+	exists, err := sessionStore.Exists(ctx, sessionKey)
 	if err != nil {
-		log.Printf("Redis error checking session: %v", err)
+		logger.Error("Redis error checking session", "error", err)
 		respondError(w, http.StatusInternalServerError, "internal_server_error")
 		return
 	}
 
-	if exists == 0 {
-		log.Printf("Session not found: %s", sessionKey)
+	if !exists {
+		logger.Info("Session not found")
 		respondJSON(w, http.StatusOK, map[string]interface{}{
 			"valid": false,
 			"error": "session_not_found",
@@ -222,21 +591,26 @@ func validateSession(w http.ResponseWriter, r *http.Request) {
 	// Validate host token if provided
 	isHost := false
 	if hostToken != "" {
-		storedToken, err := rdb.Get(ctx, "session:"+sessionKey+":host").Result()
+		isHost, err = sessionStore.ValidateHost(ctx, sessionKey, hostToken)
 		if err != nil {
-			log.Printf("Redis error getting host token: %v", err)
-		} else if storedToken == hostToken {
-			isHost = true
-			log.Printf("Host token validated for session: %s", sessionKey)
+			logger.Error("Redis error getting host token", "error", err)
+		} else if isHost {
+			logger.Info("Host token validated")
 		} else {
-			log.Printf("Invalid host token provided for session: %s", sessionKey)
+			logger.Warn("Invalid host token provided")
 		}
 	}
 
+	// Password protected sessions only admit hosts and clients with the password
+	joinToken, ok := authorizeJoin(w, r, sessionKey, isHost)
+	if !ok {
+		return
+	}
+
 	// Get streaming server for the session
-	server := getLeastLoadedServer()
+	server := getSessionServer(logger, sessionKey)
 	if server == nil {
-		log.Printf("No streaming servers available for session: %s", sessionKey)
+		logger.Error("No streaming servers available")
 		respondError(w, http.StatusServiceUnavailable, "no_streaming_servers_available")
 		return
 	}
@@ -247,34 +621,386 @@ func validateSession(w http.ResponseWriter, r *http.Request) {
 	}
 	serverURL = strings.TrimSuffix(serverURL, "/")
 
-	log.Printf("Session validated - Key: %s, Is Host: %v, Server: %s", sessionKey, isHost, server.ID)
+	logger.Info("Session validated", "is_host", isHost, "server_id", server.ID)
 
-	respondJSON(w, http.StatusOK, map[string]interface{}{
+	response := map[string]interface{}{
 		"valid":         true,
 		"isHost":        isHost,
 		"streaming_url": serverURL, // Send direct video URL
+	}
+	if joinToken != "" {
+		response["joinToken"] = joinToken
+	}
+	respondJSON(w, http.StatusOK, response)
+}
+
+// authorizeJoin enforces a session's password. Clients allowed in get a join
+// token to present to the streaming server; sessions without a password need
+// none. Otherwise it writes the error response and returns false.
+func authorizeJoin(w http.ResponseWriter, r *http.Request, sessionKey string, isHost bool) (string, bool) {
+	logger := settings.Logger(r.Context()).With("session_id", sessionKey)
+	hash, err := rdb.Get(ctx, store.Key(sessionKey, store.Password)).Result()
+	if err == redis.Nil {
+		return "", true
+	} else if err != nil {
+		logger.Error("Redis error getting session password", "error", err)
+		respondError(w, http.StatusInternalServerError, "internal_server_error")
+		return "", false
+	}
+
+	if !isHost {
+		password := r.Header.Get(sessionPasswordHeader)
+		if password == "" {
+			password = r.URL.Query().Get("password")
+		}
+		if password == "" {
+			respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+				"valid": false,
+				"error": "password_required",
+			})
+			return "", false
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			logger.Warn("Invalid password provided")
+			respondJSON(w, http.StatusForbidden, map[string]interface{}{
+				"valid": false,
+				"error": "invalid_password",
+			})
+			return "", false
+		}
+	}
+
+	joinToken := uuid.New().String()
+	err = rdb.SetEX(ctx, store.JoinKey(sessionKey, joinToken), "1", joinTokenTTL).Err()
+	if err != nil {
+		logger.Error("Redis error storing join token", "error", err)
+		respondError(w, http.StatusInternalServerError, "internal_server_error")
+		return "", false
+	}
+	return joinToken, true
+}
+
+// Session listing endpoint, returns the creator's sessions that are still
+// live to the holder of the creator's owner token
+func listSessions(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		respondError(w, http.StatusBadRequest, "missing_owner")
+		return
+	}
+
+	isOwner, err := sessionStore.ValidateOwner(ctx, owner, r.Header.Get("X-Owner-Token"))
+	if err != nil {
+		settings.Logger(r.Context()).Error("Redis error getting owner token", "owner", owner, "error", err)
+		respondError(w, http.StatusInternalServerError, "internal_server_error")
+		return
+	}
+	if !isOwner {
+		respondError(w, http.StatusForbidden, "invalid_owner_token")
+		return
+	}
+
+	ownerKey := store.OwnerSessionsKey(owner)
+	keys, err := rdb.SMembers(ctx, ownerKey).Result()
+	if err != nil {
+		settings.Logger(r.Context()).Error("Redis error listing sessions", "owner", owner, "error", err)
+		respondError(w, http.StatusInternalServerError, "internal_server_error")
+		return
+	}
+
+	sessions := []map[string]interface{}{}
+	for _, sessionKey := range keys {
+		meta, err := rdb.HGetAll(ctx, store.Key(sessionKey, store.Meta)).Result()
+		if err != nil {
+			settings.Logger(r.Context()).Error("Redis error getting session metadata", "session_id", sessionKey, "error", err)
+			continue
+		}
+		exists, err := sessionStore.Exists(ctx, sessionKey)
+		if err != nil {
+			continue
+		}
+		if !exists || len(meta) == 0 {
+			// Expired, prune it from the index
+			rdb.SRem(ctx, ownerKey, sessionKey)
+			continue
+		}
+
+		participants, _ := rdb.Get(ctx, store.Key(sessionKey, store.Participants)).Int()
+		serverID, _ := sessionStore.AssignedServer(ctx, sessionKey)
+		sessions = append(sessions, map[string]interface{}{
+			"sessionKey":   sessionKey,
+			"title":        meta["title"],
+			"createdAt":    meta["createdAt"],
+			"participants": participants,
+			"server":       serverID,
+		})
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"sessions": sessions,
 	})
 }
 
-func getLeastLoadedServer() *StreamingServer {
-	serverMutex.RLock()
-	defer serverMutex.RUnlock()
+// Video manifest endpoint, returns the manifest the upload server stored
+// for the session so clients know the duration before connecting
+func getManifest(w http.ResponseWriter, r *http.Request) {
+	sessionKey := mux.Vars(r)["key"]
+	if !validSessionKey(sessionKey) {
+		respondError(w, http.StatusBadRequest, "invalid_session_key")
+		return
+	}
 
-	var bestServer *StreamingServer
-	lowestLoad := float64(1.0)
+	manifest, err := rdb.Get(ctx, store.Key(sessionKey, store.Manifest)).Result()
+	if err == redis.Nil {
+		exists, err := sessionStore.Exists(ctx, sessionKey)
+		if err == nil && !exists {
+			respondError(w, http.StatusNotFound, "session_not_found")
+			return
+		}
+		respondError(w, http.StatusNotFound, "manifest_not_found")
+		return
+	} else if err != nil {
+		settings.Logger(r.Context()).Error("Redis error getting manifest", "session_id", sessionKey, "error", err)
+		respondError(w, http.StatusInternalServerError, "internal_server_error")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, json.RawMessage(manifest))
+}
+
+// Session teardown endpoint, only the host may end a session early
+func deleteSession(w http.ResponseWriter, r *http.Request) {
+	sessionKey := mux.Vars(r)["key"]
+	if !validSessionKey(sessionKey) {
+		respondError(w, http.StatusBadRequest, "invalid_session_key")
+		return
+	}
+	hostToken := r.Header.Get("X-Host-Token")
+	if hostToken == "" {
+		hostToken = r.URL.Query().Get("hostToken")
+	}
+
+	logger := settings.Logger(r.Context()).With("session_id", sessionKey)
+
+	logger.Info("Deleting session", "host_token_provided", hostToken != "")
+
+	isHost, err := sessionStore.ValidateHost(ctx, sessionKey, hostToken)
+	if err == store.ErrSessionNotFound {
+		logger.Info("Session not found")
+		respondError(w, http.StatusNotFound, "session_not_found")
+		return
+	} else if err != nil {
+		logger.Error("Redis error getting host token", "error", err)
+		respondError(w, http.StatusInternalServerError, "internal_server_error")
+		return
+	}
+
+	if !isHost {
+		logger.Warn("Invalid host token provided for session deletion")
+		respondError(w, http.StatusForbidden, "invalid_host_token")
+		return
+	}
+
+	creator, _ := rdb.HGet(ctx, store.Key(sessionKey, store.Meta), "creator").Result()
+
+	if err := sessionStore.Delete(ctx, sessionKey); err != nil {
+		logger.Error("Redis error deleting session", "error", err)
+		respondError(w, http.StatusInternalServerError, "internal_server_error")
+		return
+	}
+
+	if creator != "" {
+		rdb.SRem(ctx, store.OwnerSessionsKey(creator), sessionKey)
+	}
+
+	// Let the streaming servers disconnect everyone still in the session
+	payload, _ := json.Marshal(map[string]string{"type": "sessionEnded"})
+	if err := sessionStore.Publish(ctx, sessionKey, payload); err != nil {
+		logger.Error("Redis error publishing session end", "error", err)
+	}
+
+	// And the upload server remove the session's video from S3
+	if err := rdb.Publish(ctx, sessionEndedChannel, sessionKey).Err(); err != nil {
+		logger.Error("Redis error publishing S3 cleanup", "error", err)
+	}
+
+	logger.Info("Session deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Host handoff endpoint. The current host trades its token for a new one to
+// hand to the next host, and the old token stops working. Naming a connected
+// participant makes that connection the host right away.
+func transferHost(w http.ResponseWriter, r *http.Request) {
+	sessionKey := mux.Vars(r)["key"]
+	if !validSessionKey(sessionKey) {
+		respondError(w, http.StatusBadRequest, "invalid_session_key")
+		return
+	}
+	hostToken := r.Header.Get("X-Host-Token")
+	if hostToken == "" {
+		hostToken = r.URL.Query().Get("hostToken")
+	}
+	if hostToken == "" {
+		respondError(w, http.StatusForbidden, "invalid_host_token")
+		return
+	}
+
+	var req struct {
+		ParticipantID string `json:"participantId"` // connection to make host, optional
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		respondError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	if req.ParticipantID != "" {
+		if _, err := uuid.Parse(req.ParticipantID); err != nil {
+			respondError(w, http.StatusBadRequest, "invalid_participant_id")
+			return
+		}
+	}
+
+	logger := settings.Logger(r.Context()).With("session_id", sessionKey)
+	newToken := uuid.New().String()
+	err := sessionStore.TransferHost(ctx, sessionKey, hostToken, newToken)
+	switch {
+	case err == store.ErrSessionNotFound:
+		respondError(w, http.StatusNotFound, "session_not_found")
+		return
+	case err == store.ErrInvalidHostToken:
+		logger.Warn("Invalid host token provided for host transfer")
+		respondError(w, http.StatusForbidden, "invalid_host_token")
+		return
+	case err != nil:
+		logger.Error("Redis error transferring host", "error", err)
+		respondError(w, http.StatusInternalServerError, "internal_server_error")
+		return
+	}
+
+	// Let the streaming servers move host control off the old host's connection
+	payload, _ := json.Marshal(map[string]string{
+		"type":          "hostChanged",
+		"participantId": req.ParticipantID,
+	})
+	if err := sessionStore.Publish(ctx, sessionKey, payload); err != nil {
+		logger.Error("Redis error publishing host change", "error", err)
+	}
+
+	logger.Info("Host transferred", "participant_id", req.ParticipantID)
+	respondJSON(w, http.StatusOK, map[string]string{
+		"hostToken": newToken,
+	})
+}
+
+// getSessionServer returns the streaming server assigned to a session so that
+// every participant lands on the same process. A new server is only picked
+// when the session has none yet or its assigned server is no longer active.
+func getSessionServer(logger *slog.Logger, sessionKey string) *StreamingServer {
+	serverID, err := sessionStore.AssignedServer(ctx, sessionKey)
+	if err != nil {
+		logger.Error("Redis error getting assigned server", "error", err)
+	}
+	if serverID != "" {
+		server, err := getStreamingServer(serverID)
+		if err == nil && server.Status == "active" {
+			return server
+		}
+		logger.Warn("Assigned server is gone, reassigning", "server_id", serverID)
+	}
+
+	server := selectServer(sessionKey)
+	if server == nil {
+		return nil
+	}
+
+	// Replace a stale assignment. Otherwise this is the first validate for the
+	// session, and a concurrent validate may have won the race.
+	assignedID, err := sessionStore.AssignServer(ctx, sessionKey, server.ID, serverID != "", sessionExpiry)
+	if err != nil {
+		logger.Error("Redis error assigning server", "error", err)
+		return server
+	}
+	if assignedID != server.ID {
+		if winner, err := getStreamingServer(assignedID); err == nil && winner.Status == "active" {
+			return winner
+		}
+	}
+	return server
+}
+
+// selectServer picks a streaming server for a session using the configured strategy
+func selectServer(sessionKey string) *StreamingServer {
+	if serverSelection == selectConsistentHash {
+		return getHashedServer(sessionKey)
+	}
+	return getLeastLoadedServer()
+}
+
+// getHashedServer maps the session onto a consistent hash ring of the active
+// servers, skipping servers that are full
+func getHashedServer(sessionKey string) *StreamingServer {
+	ring := newHashRing(getActiveServers())
+	return ring.get(sessionKey, func(server *StreamingServer) bool {
+		ratio, ok := currentLoadRatio(server)
+		return ok && ratio < 1.0
+	})
+}
+
+// getActiveServers returns every registered server that is still active
+func getActiveServers() []*StreamingServer {
+	ids, err := rdb.ZRange(ctx, streamingServerLoadKey, 0, -1).Result()
+	if err != nil {
+		slog.Error("Redis error listing streaming servers", "error", err)
+		return nil
+	}
+
+	var servers []*StreamingServer
+	for _, id := range ids {
+		server, err := getStreamingServer(id)
+		if err != nil || server.Status != "active" || server.Capacity <= 0 {
+			continue
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+func getLeastLoadedServer() *StreamingServer {
+	// Servers are ordered by load ratio, so the first live, active one wins
+	ids, err := rdb.ZRange(ctx, streamingServerLoadKey, 0, -1).Result()
+	if err != nil {
+		slog.Error("Redis error listing streaming servers", "error", err)
+		return nil
+	}
 
-	for _, server := range streamingServers {
-		if server.Status != "active" {
+	var candidates []*StreamingServer
+	for _, id := range ids {
+		server, err := getStreamingServer(id)
+		if err == redis.Nil {
+			// Registry entry expired, cleanupInactiveServers removes it from
+			// the load index and moves its clients
+			continue
+		} else if err != nil {
+			slog.Error("Redis error getting streaming server", "server_id", id, "error", err)
+			continue
+		}
+		if server.Status != "active" || server.Capacity <= 0 {
+			continue
+		}
+		if liveLoadCheck {
+			// Heartbeat order may be stale, every server is a candidate
+			candidates = append(candidates, server)
 			continue
 		}
-		load := float64(server.CurrentLoad) / float64(server.Capacity)
-		if load < lowestLoad {
-			lowestLoad = load
-			bestServer = server
+		if float64(server.CurrentLoad)/float64(server.Capacity) < 1.0 {
+			return server
 		}
 	}
 
-	return bestServer
+	if liveLoadCheck {
+		return pickLiveLeastLoaded(candidates)
+	}
+	return nil
 }
 
 func registerStreamingServer(w http.ResponseWriter, r *http.Request) {
@@ -284,14 +1010,43 @@ func registerStreamingServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	token := r.Header.Get(serverTokenHeader)
+	if server.ID == "" || token == "" {
+		http.Error(w, "Missing server ID or token", http.StatusBadRequest)
+		return
+	}
+
 	server.Registered = time.Now()
 	server.LastPing = time.Now().Unix()
 
-	serverMutex.Lock()
-	streamingServers[server.ID] = &server
-	serverMutex.Unlock()
+	registered, err := registerScript.Run(ctx, rdb,
+		[]string{streamingServerKeyPrefix + server.ID, streamingServerLoadKey},
+		token,
+		streamingServerTTL.Milliseconds(),
+		loadRatio(&server),
+		server.ID,
+		"id", server.ID,
+		"url", server.URL,
+		"capacity", server.Capacity,
+		"currentLoad", server.CurrentLoad,
+		"status", server.Status,
+		"lastPing", server.LastPing,
+		"heartbeatAt", time.Now().UnixMilli(),
+		"registered", server.Registered.Format(time.RFC3339),
+	).Int()
+	if err != nil {
+		settings.Logger(r.Context()).Error("Redis error registering streaming server", "server_id", server.ID, "error", err)
+		http.Error(w, "Failed to register server", http.StatusInternalServerError)
+		return
+	}
+	if registered == 0 {
+		settings.Logger(r.Context()).Warn("Rejected registration, ID held by another active server", "server_id", server.ID)
+		http.Error(w, "Server ID already registered", http.StatusConflict)
+		return
+	}
 
-	log.Printf("Registered streaming server: %s", server.ID)
+	forgetLiveLoad(server.ID)
+	settings.Logger(r.Context()).Info("Registered streaming server", "server_id", server.ID, "url", server.URL)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -302,34 +1057,190 @@ func handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	serverMutex.Lock()
-	if existingServer, exists := streamingServers[server.ID]; exists {
-		existingServer.CurrentLoad = server.CurrentLoad
-		existingServer.LastPing = time.Now().Unix()
-		existingServer.Status = "active"
+	// The reported ping time orders heartbeats; fall back to arrival time
+	heartbeatAt := server.LastPing * 1000
+	if heartbeatAt <= 0 {
+		heartbeatAt = time.Now().UnixMilli()
+	}
+
+	known, err := heartbeatScript.Run(ctx, rdb,
+		[]string{streamingServerKeyPrefix + server.ID, streamingServerLoadKey},
+		heartbeatAt,
+		server.CurrentLoad,
+		time.Now().Unix(),
+		loadRatio(&server),
+		streamingServerTTL.Milliseconds(),
+		server.ID,
+		r.Header.Get(serverTokenHeader),
+	).Int()
+	if err != nil {
+		settings.Logger(r.Context()).Error("Redis error handling heartbeat", "server_id", server.ID, "error", err)
+		http.Error(w, "Failed to record heartbeat", http.StatusInternalServerError)
+		return
+	}
+	if known == -1 {
+		settings.Logger(r.Context()).Warn("Rejected heartbeat, token mismatch", "server_id", server.ID)
+		http.Error(w, "Invalid server token", http.StatusForbidden)
+		return
+	}
+	if known == 0 {
+		// Entry expired; the streaming server has to register again
+		http.Error(w, "Unknown server", http.StatusNotFound)
+		return
 	}
-	serverMutex.Unlock()
+
+	heartbeatsReceived.Inc()
+	serverLoadRatio.WithLabelValues(server.ID).Set(loadRatio(&server))
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func cleanupInactiveServers() {
+// deregisterStreamingServer removes a server that is shutting down, so new
+// and reconnecting clients are sent elsewhere right away instead of after its
+// registry entry expires
+func deregisterStreamingServer(w http.ResponseWriter, r *http.Request) {
+	var server StreamingServer
+	if err := json.NewDecoder(r.Body).Decode(&server); err != nil || server.ID == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	removed, err := deregisterScript.Run(ctx, rdb,
+		[]string{streamingServerKeyPrefix + server.ID, streamingServerLoadKey},
+		r.Header.Get(serverTokenHeader),
+		server.ID,
+	).Int()
+	if err != nil {
+		settings.Logger(r.Context()).Error("Redis error deregistering streaming server", "server_id", server.ID, "error", err)
+		http.Error(w, "Failed to deregister server", http.StatusInternalServerError)
+		return
+	}
+	if removed == -1 {
+		settings.Logger(r.Context()).Warn("Rejected deregistration, token mismatch", "server_id", server.ID)
+		http.Error(w, "Invalid server token", http.StatusForbidden)
+		return
+	}
+	if removed == 0 {
+		http.Error(w, "Unknown server", http.StatusNotFound)
+		return
+	}
+
+	serverLoadRatio.DeleteLabelValues(server.ID)
+	forgetLiveLoad(server.ID)
+	settings.Logger(r.Context()).Info("Deregistered streaming server", "server_id", server.ID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// cleanupInactiveServers prunes the load index. The per-server registry keys
+// expire on their own once heartbeats stop, so this only removes index
+// members whose entry is already gone and asks their clients to reconnect.
+// It returns once stop is done.
+func cleanupInactiveServers(stop context.Context) {
 	ticker := time.NewTicker(1 * time.Minute)
-	for range ticker.C {
-		serverMutex.Lock()
-		now := time.Now().Unix()
-		for id, server := range streamingServers {
-			if now-server.LastPing > 60 { // Remove servers inactive for more than 1 minute
-				delete(streamingServers, id)
-				log.Printf("Removed inactive streaming server: %s", id)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ids, err := rdb.ZRange(ctx, streamingServerLoadKey, 0, -1).Result()
+		if err != nil {
+			slog.Error("Redis error listing streaming servers", "error", err)
+			continue
+		}
+		for _, id := range ids {
+			exists, err := rdb.Exists(ctx, streamingServerKeyPrefix+id).Result()
+			if err != nil || exists == 1 {
+				continue
 			}
+			rdb.ZRem(ctx, streamingServerLoadKey, id)
+			serverLoadRatio.DeleteLabelValues(id)
+			forgetLiveLoad(id)
+			slog.Info("Removed inactive streaming server", "server_id", id)
+			publishServerReassign(id)
 		}
-		serverMutex.Unlock()
 	}
 }
 
+// publishServerReassign tells the clients of a dead streaming server to
+// validate their session again, which hands them a live server
+func publishServerReassign(serverID string) {
+	payload, _ := json.Marshal(map[string]string{
+		"type":     "serverReassign",
+		"serverId": serverID,
+	})
+	if err := rdb.Publish(ctx, serverReassignChannel, string(payload)).Err(); err != nil {
+		slog.Error("Redis error publishing reassign", "server_id", serverID, "error", err)
+	}
+}
+
+// getStreamingServer loads a server's registry entry, returning redis.Nil if it has expired
+func getStreamingServer(id string) (*StreamingServer, error) {
+	fields, err := rdb.HGetAll(ctx, streamingServerKeyPrefix+id).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, redis.Nil
+	}
+
+	server := &StreamingServer{
+		ID:     fields["id"],
+		URL:    fields["url"],
+		Status: fields["status"],
+	}
+	server.Capacity, _ = strconv.Atoi(fields["capacity"])
+	server.CurrentLoad, _ = strconv.Atoi(fields["currentLoad"])
+	server.LastPing, _ = strconv.ParseInt(fields["lastPing"], 10, 64)
+	server.Registered, _ = time.Parse(time.RFC3339, fields["registered"])
+	return server, nil
+}
+
+func loadRatio(server *StreamingServer) float64 {
+	if server.Capacity <= 0 {
+		return 1.0
+	}
+	return float64(server.CurrentLoad) / float64(server.Capacity)
+}
+
+// Health check endpoint, 503 when a dependency is down
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	checkCtx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	status := "healthy"
+	code := http.StatusOK
+	dependencies := map[string]string{"redis": "ok"}
+	if err := rdb.Ping(checkCtx).Err(); err != nil {
+		settings.Logger(r.Context()).Warn("Health check: Redis unreachable", "error", err)
+		status = "unhealthy"
+		code = http.StatusServiceUnavailable
+		dependencies["redis"] = err.Error()
+	}
+
+	metricsMutex.Lock()
+	metrics.Status = status
+	metrics.LastHealthCheck = time.Now()
+	metricsMutex.Unlock()
+
+	respondJSON(w, code, map[string]interface{}{
+		"status":       status,
+		"dependencies": dependencies,
+	})
+}
+
 /////////////////////////////////////// HELPER FUNCTIONS //////////////////////////////////////////////////////////////
 
+// validSessionKey reports whether key looks like a session key we generated,
+// i.e. a UUID in its canonical form
+func validSessionKey(key string) bool {
+	id, err := uuid.Parse(key)
+	return err == nil && id.String() == key
+}
+
 func respondJSON(w http.ResponseWriter, statusCode int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+
+	"github.com/mayank447/videosync/store"
+)
+
+// setupRedis points the server at a fresh miniredis for the test
+func setupRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	sessionStore = store.NewSessionStore(rdb)
+	t.Cleanup(func() { rdb.Close() })
+	return mr
+}
+
+// addServer registers an active streaming server with room for clients
+func addServer(t *testing.T, id string) {
+	t.Helper()
+	body := `{"id": "` + id + `", "url": "http://` + id + `:8081", "capacity": 10, "status": "active"}`
+	req := httptest.NewRequest("POST", "/api/streaming-servers/register", strings.NewReader(body))
+	req.Header.Set(serverTokenHeader, "token-"+id)
+	rec := httptest.NewRecorder()
+	registerStreamingServer(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("registering %s: %d %s", id, rec.Code, rec.Body)
+	}
+}
+
+func TestValidateSessionEncodedKey(t *testing.T) {
+	setupRedis(t)
+	addServer(t, "s1")
+	const sessionKey = "0b3c9a4e-6f52-4d9e-9a51-3f2b8c7d1e00"
+	if _, err := sessionStore.CreateSession(ctx, sessionKey, "host-token", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/sessions/{key}/validate", validateSession).Methods("GET")
+
+	tests := []struct {
+		name     string
+		path     string
+		wantCode int
+		valid    bool
+	}{
+		{"plain", "/api/sessions/" + sessionKey + "/validate", http.StatusOK, true},
+		{"encoded", "/api/sessions/" + strings.ReplaceAll(sessionKey, "-", "%2D") + "/validate", http.StatusOK, true},
+		{"not a uuid", "/api/sessions/" + strings.ToUpper(sessionKey) + "/validate", http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			var resp struct {
+				Valid        bool   `json:"valid"`
+				StreamingURL string `json:"streaming_url"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			if resp.Valid != tt.valid {
+				t.Errorf("valid = %v, want %v", resp.Valid, tt.valid)
+			}
+			if tt.valid && resp.StreamingURL != "http://s1:8081" {
+				t.Errorf("streaming_url = %q", resp.StreamingURL)
+			}
+		})
+	}
+}
+
+func TestRegisterStreamingServerConflict(t *testing.T) {
+	setupRedis(t)
+
+	register := func(token string) int {
+		body := `{"id": "s1", "url": "http://s1:8081", "capacity": 10, "status": "active"}`
+		req := httptest.NewRequest("POST", "/api/streaming-servers/register", strings.NewReader(body))
+		req.Header.Set(serverTokenHeader, token)
+		rec := httptest.NewRecorder()
+		registerStreamingServer(rec, req)
+		return rec.Code
+	}
+
+	if code := register("first"); code != http.StatusOK {
+		t.Fatalf("first registration = %d", code)
+	}
+	if code := register("second"); code != http.StatusConflict {
+		t.Errorf("registration with another token = %d, want 409", code)
+	}
+	if code := register("first"); code != http.StatusOK {
+		t.Errorf("re-registration with the same token = %d, want 200", code)
+	}
+
+	token, err := rdb.HGet(ctx, streamingServerKeyPrefix+"s1", "token").Result()
+	if err != nil || token != "first" {
+		t.Errorf("stored token = %q, %v", token, err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	sessionsCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "videosync_sessions_created_total",
+		Help: "Sessions created.",
+	})
+	sessionsRateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "videosync_sessions_rate_limited_total",
+		Help: "Session creations rejected by the rate limiter.",
+	})
+	heartbeatsReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "videosync_heartbeats_total",
+		Help: "Streaming server heartbeats received.",
+	})
+	serverLoadRatio = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "videosync_streaming_server_load_ratio",
+		Help: "Last reported load of each streaming server as a fraction of its capacity.",
+	}, []string{"server"})
+	redisErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "videosync_redis_errors_total",
+		Help: "Failed Redis commands.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "videosync_streaming_servers",
+		Help: "Streaming servers in the registry.",
+	}, func() float64 {
+		n, err := rdb.ZCard(ctx, streamingServerLoadKey).Result()
+		if err != nil {
+			return 0
+		}
+		return float64(n)
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "videosync_active_sessions",
+		Help: "Sessions that haven't expired.",
+	}, countActiveSessions)
+)
+
+// countActiveSessions reads the store's index of live sessions, which is
+// kept up to date as sessions are created, slide and get deleted
+func countActiveSessions() float64 {
+	count, err := sessionStore.CountActive(ctx)
+	if err != nil {
+		slog.Error("Redis error counting sessions", "error", err)
+	}
+	return float64(count)
+}
@@ -0,0 +1,154 @@
+package settings
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// RequestIDHeader carries a request's ID from the client through every server
+// that handles it, and back in the response
+const RequestIDHeader = "X-Request-ID"
+
+// Longest request ID accepted from a caller, longer ones are replaced
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// SetupLogging switches slog and the standard log package to JSON lines on
+// stderr, each tagged with the service name
+func SetupLogging(service string) {
+	handler := slog.NewJSONHandler(os.Stderr, nil)
+	slog.SetDefault(slog.New(handler).With("service", service))
+}
+
+// RequestID is middleware that gives each request an ID, keeping the caller's
+// X-Request-ID when it sent a usable one so a request can be followed across
+// the servers
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestIDFrom returns the request ID stored in ctx, "" outside a request
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Logger returns the default logger with ctx's request ID attached
+func Logger(ctx context.Context) *slog.Logger {
+	if id := RequestIDFrom(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// LogRequests is router middleware that logs each request once it has been
+// served, with the session it concerns when the route has one
+func LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.statusCode(),
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote_addr", r.RemoteAddr,
+		}
+		if sessionID := requestSessionID(r); sessionID != "" {
+			attrs = append(attrs, "session_id", sessionID)
+		}
+		Logger(r.Context()).Info("request", attrs...)
+	})
+}
+
+// requestSessionID finds the session a request is for, named key or sessionID
+// in the route, or sessionID in the query for WebSockets
+func requestSessionID(r *http.Request) string {
+	vars := mux.Vars(r)
+	if id := vars["key"]; id != "" {
+		return id
+	}
+	if id := vars["sessionID"]; id != "" {
+		return id
+	}
+	return r.URL.Query().Get("sessionID")
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder remembers the status code written through it. It passes
+// Hijack and Flush through so WebSockets and streamed responses still work.
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	hijacked bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	s.hijacked = true
+	return h.Hijack()
+}
+
+func (s *statusRecorder) statusCode() int {
+	switch {
+	case s.status != 0:
+		return s.status
+	case s.hijacked:
+		return http.StatusSwitchingProtocols
+	default:
+		return http.StatusOK
+	}
+}
@@ -0,0 +1,43 @@
+package settings
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// redisErrorHook counts failed Redis commands. redis.Nil is a normal "key
+// not found" result, not an error.
+type redisErrorHook struct {
+	errors prometheus.Counter
+}
+
+// CountRedisErrors increments counter for every failed command run by rdb
+func CountRedisErrors(rdb *redis.Client, counter prometheus.Counter) {
+	rdb.AddHook(redisErrorHook{errors: counter})
+}
+
+func (h redisErrorHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h redisErrorHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if err := cmd.Err(); err != nil && err != redis.Nil {
+		h.errors.Inc()
+	}
+	return nil
+}
+
+func (h redisErrorHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h redisErrorHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil && err != redis.Nil {
+			h.errors.Inc()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+// Package settings holds the configuration shared by the main, streaming and
+// upload servers so that all three talk to the same Redis and S3 bucket.
+package settings
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/go-redis/redis/v8"
+)
+
+type Settings struct {
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+	AWSRegion     string
+	S3Bucket      string
+
+	// How long a server waits for in-flight work when asked to stop
+	ShutdownTimeout time.Duration
+
+	// Serve HTTPS when both are set
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// Web origins allowed to call the APIs and open WebSockets, parsed from
+	// allowedOrigins by Validate. Empty allows every origin.
+	AllowedOrigins []string
+	allowedOrigins string
+
+	// Proxies whose X-Forwarded-For is believed, parsed from trustedProxies
+	// by Validate. Empty ignores the header.
+	TrustedProxies []*net.IPNet
+	trustedProxies string
+}
+
+// Register adds the shared flags to the command line flag set. Each flag
+// defaults to its environment variable, so flags override env. Call it before
+// flag.Parse and Validate after.
+func Register() *Settings {
+	s := &Settings{}
+	flag.StringVar(&s.RedisAddr, "redis-addr", EnvOr("REDIS_ADDR", "localhost:6379"), "Redis address (env REDIS_ADDR)")
+	flag.StringVar(&s.RedisPassword, "redis-password", os.Getenv("REDIS_PASSWORD"), "Redis password (env REDIS_PASSWORD)")
+	flag.IntVar(&s.RedisDB, "redis-db", EnvInt("REDIS_DB", 0), "Redis database number (env REDIS_DB)")
+	flag.StringVar(&s.AWSRegion, "aws-region", os.Getenv("AWS_REGION"), "AWS region of the S3 bucket (env AWS_REGION)")
+	flag.StringVar(&s.S3Bucket, "s3-bucket", os.Getenv("S3_BUCKET"), "S3 bucket holding the HLS output (env S3_BUCKET)")
+	flag.DurationVar(&s.ShutdownTimeout, "shutdown-timeout", EnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		"How long to wait for in-flight work on SIGTERM (env SHUTDOWN_TIMEOUT)")
+	flag.StringVar(&s.TLSCertFile, "tls-cert-file", os.Getenv("TLS_CERT_FILE"), "TLS certificate, enables HTTPS with -tls-key-file (env TLS_CERT_FILE)")
+	flag.StringVar(&s.TLSKeyFile, "tls-key-file", os.Getenv("TLS_KEY_FILE"), "TLS private key (env TLS_KEY_FILE)")
+	flag.StringVar(&s.allowedOrigins, "allowed-origins", os.Getenv("ALLOWED_ORIGINS"),
+		"Comma separated web origins allowed to connect, e.g. https://watch.example.com; empty allows all (env ALLOWED_ORIGINS)")
+	flag.StringVar(&s.trustedProxies, "trusted-proxies", os.Getenv("TRUSTED_PROXIES"),
+		"Comma separated IPs or CIDRs of proxies whose X-Forwarded-For is trusted; empty trusts none (env TRUSTED_PROXIES)")
+	return s
+}
+
+// Validate checks the parsed settings, requiring the S3 settings only for
+// servers that use S3
+func (s *Settings) Validate(needS3 bool) error {
+	if s.RedisAddr == "" {
+		return errors.New("redis address must be set (-redis-addr or REDIS_ADDR)")
+	}
+	if s.RedisDB < 0 {
+		return errors.New("redis database must not be negative")
+	}
+	if s.ShutdownTimeout <= 0 {
+		return errors.New("shutdown timeout must be positive")
+	}
+	if (s.TLSCertFile == "") != (s.TLSKeyFile == "") {
+		return errors.New("TLS needs both a certificate and a key (-tls-cert-file/TLS_CERT_FILE and -tls-key-file/TLS_KEY_FILE)")
+	}
+	s.AllowedOrigins = nil
+	for _, origin := range strings.Split(s.allowedOrigins, ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin == "" {
+			continue
+		}
+		if !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return errors.New("allowed origin " + origin + " must start with http:// or https://")
+		}
+		s.AllowedOrigins = append(s.AllowedOrigins, origin)
+	}
+	s.TrustedProxies = nil
+	for _, proxy := range strings.Split(s.trustedProxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return errors.New("trusted proxy " + proxy + " is not an IP or CIDR")
+		}
+		s.TrustedProxies = append(s.TrustedProxies, network)
+	}
+	if needS3 && (s.AWSRegion == "" || s.S3Bucket == "") {
+		return errors.New("AWS region and S3 bucket must be set (-aws-region/AWS_REGION and -s3-bucket/S3_BUCKET)")
+	}
+	return nil
+}
+
+// NewRedisClient returns a client for the configured Redis
+func (s *Settings) NewRedisClient() *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:     s.RedisAddr,
+		Password: s.RedisPassword,
+		DB:       s.RedisDB,
+	})
+}
+
+// TLSEnabled reports whether a certificate and key were configured
+func (s *Settings) TLSEnabled() bool {
+	return s.TLSCertFile != "" && s.TLSKeyFile != ""
+}
+
+// ListenAndServe runs srv over HTTPS when TLS is configured, HTTP otherwise
+func (s *Settings) ListenAndServe(srv *http.Server) error {
+	if s.TLSEnabled() {
+		return srv.ListenAndServeTLS(s.TLSCertFile, s.TLSKeyFile)
+	}
+	return srv.ListenAndServe()
+}
+
+// CORSOrigins returns the origins for the CORS middleware, "*" when any
+// origin is allowed
+func (s *Settings) CORSOrigins() []string {
+	if len(s.AllowedOrigins) == 0 {
+		return []string{"*"}
+	}
+	return s.AllowedOrigins
+}
+
+// CheckOrigin reports whether a request's Origin is allowed. Requests without
+// one don't come from a browser page and are let through.
+func (s *Settings) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(s.AllowedOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range s.AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadAWSConfig loads the default AWS config for the configured region
+func (s *Settings) LoadAWSConfig(ctx context.Context) (aws.Config, error) {
+	return config.LoadDefaultConfig(ctx, config.WithRegion(s.AWSRegion))
+}
+
+// EnvOr returns the environment variable key, or fallback when it's unset
+func EnvOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// EnvInt returns the environment variable key as an int, or fallback when
+// it's unset. An unparsable value is fatal.
+func EnvInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("invalid %s %q", key, v)
+	}
+	return n
+}
+
+// EnvDuration returns the environment variable key as a duration, or
+// fallback when it's unset. An unparsable value is fatal.
+func EnvDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid %s %q", key, v)
+	}
+	return d
+}
+
+// EnvBool returns the environment variable key as a bool, or fallback when
+// it's unset. An unparsable value is fatal.
+func EnvBool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("invalid %s %q", key, v)
+	}
+	return b
+}
+
+// ClientIP returns the address a request came from. X-Forwarded-For is only
+// believed when the request arrived from one of trusted, and then the client
+// is its rightmost entry that isn't a trusted proxy itself, since anything to
+// the left of that was written by the client.
+func ClientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrusted(host, trusted) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			// Garbage in the chain, stop at the last address we can vouch for
+			return host
+		}
+		host = hop
+		if !isTrusted(hop, trusted) {
+			return hop
+		}
+	}
+	return host
+}
+
+func isTrusted(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
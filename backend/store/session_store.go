@@ -0,0 +1,386 @@
+// Package store owns how sessions are laid out in Redis, so that the main,
+// streaming and upload servers agree on key names, the pub/sub channel and
+// the playback state format.
+package store
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// A session lives under session:{id}, with one key per part below
+const (
+	keyPrefix = "session:"
+
+	Host         = "host"          // host token
+	State        = "state"         // PlaybackState JSON
+	Server       = "server"        // ID of the assigned streaming server
+	Meta         = "meta"          // title, creator and createdAt hash
+	Manifest     = "manifest"      // video manifest JSON, written by the upload server
+	Chat         = "chat"          // recent chat messages
+	Participants = "participants"  // connected client count
+	UploadStatus = "upload-status" // latest upload progress
+	Password     = "password"      // bcrypt hash, only for private sessions
+	Banned       = "banned"        // clientIds and addresses of kicked clients
+
+	// Messages for a session's clients are published on session-updates:{id}
+	updatesChannelPrefix = "session-updates:"
+
+	// Live sessions scored by when they expire, in milliseconds since the
+	// Unix epoch, so they can be counted without scanning the keyspace
+	activeSessionsKey = "sessions:active"
+
+	// A creator's sessions are indexed under owner:{creator}:sessions, and
+	// listing them takes the owner token at owner:{creator}:token
+	ownerPrefix = "owner:"
+)
+
+// Every part of a session, dropped with it and kept alive with its state
+var parts = []string{Host, State, Server, Meta, Manifest, Chat, Participants, UploadStatus, Password, Banned}
+
+var (
+	ErrSessionNotFound   = errors.New("session not found")
+	ErrInvalidHostToken  = errors.New("invalid host token")
+	ErrInvalidOwnerToken = errors.New("invalid owner token")
+)
+
+// PlaybackState is a session's stored playback position
+type PlaybackState struct {
+	Paused       bool    `json:"paused"`
+	CurrentTime  float64 `json:"currentTime"`
+	PlaybackRate float64 `json:"playbackRate"`
+	Timestamp    int64   `json:"timestamp"` // milliseconds since the Unix epoch
+}
+
+// InitialState is the state of a new session: paused at the start
+func InitialState(now time.Time) PlaybackState {
+	return PlaybackState{
+		Paused:       true,
+		PlaybackRate: 1,
+		Timestamp:    now.UnixMilli(),
+	}
+}
+
+// Key returns the Redis key of a part of a session, or of the session itself
+// when part is ""
+func Key(sessionID, part string) string {
+	if part == "" {
+		return keyPrefix + sessionID
+	}
+	return keyPrefix + sessionID + ":" + part
+}
+
+// JoinKey is the key admitting the holder of joinToken to a private session
+func JoinKey(sessionID, joinToken string) string {
+	return keyPrefix + sessionID + ":join:" + joinToken
+}
+
+// Keys returns the session's own key followed by the keys of all its parts
+func Keys(sessionID string) []string {
+	keys := []string{Key(sessionID, "")}
+	for _, part := range parts {
+		keys = append(keys, Key(sessionID, part))
+	}
+	return keys
+}
+
+// OwnerSessionsKey is the set of the IDs of creator's sessions
+func OwnerSessionsKey(creator string) string {
+	return ownerPrefix + creator + ":sessions"
+}
+
+// OwnerTokenKey holds the token proving ownership of creator's sessions
+func OwnerTokenKey(creator string) string {
+	return ownerPrefix + creator + ":token"
+}
+
+// UpdatesChannel is the pub/sub channel of a session's messages
+func UpdatesChannel(sessionID string) string {
+	return updatesChannelPrefix + sessionID
+}
+
+// SessionFromChannel returns the session an updates channel belongs to
+func SessionFromChannel(channel string) (string, bool) {
+	return strings.CutPrefix(channel, updatesChannelPrefix)
+}
+
+// createSessionScript stores a new session, its host token ARGV[1] and state
+// ARGV[2], all expiring after ARGV[3] milliseconds, unless KEYS[1] is taken,
+// and adds session ARGV[4] to the active sessions KEYS[4] with expiry ARGV[5].
+// KEYS are the session, host and state keys. Returns 0 if taken, 1 otherwise.
+var createSessionScript = redis.NewScript(`
+if not redis.call("SET", KEYS[1], "active", "PX", ARGV[3], "NX") then
+	return 0
+end
+redis.call("SET", KEYS[2], ARGV[1], "PX", ARGV[3])
+redis.call("SET", KEYS[3], ARGV[2], "PX", ARGV[3])
+redis.call("ZADD", KEYS[4], ARGV[5], ARGV[4])
+return 1
+`)
+
+// setStateScript stores a session's state and pushes the expiry of all of
+// the session's keys forward by ARGV[2] milliseconds, in one step. An expired
+// session is left alone rather than having its keys recreated. The creator's
+// index, named in the meta hash, is kept alive at least as long.
+// KEYS[1] is session:{id}, KEYS[2] its state, KEYS[3] its meta, KEYS[4] the
+// active sessions and the rest its other keys. ARGV[3] is the owner key
+// prefix, ARGV[4] the session ID and ARGV[5] its new expiry.
+var setStateScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("SET", KEYS[2], ARGV[1], "PX", ARGV[2])
+for i, key in ipairs(KEYS) do
+	if i ~= 2 and i ~= 4 then
+		redis.call("PEXPIRE", key, ARGV[2])
+	end
+end
+redis.call("ZADD", KEYS[4], ARGV[5], ARGV[4])
+local creator = redis.call("HGET", KEYS[3], "creator")
+if creator and creator ~= "" then
+	for _, key in ipairs({ARGV[3] .. creator .. ":sessions", ARGV[3] .. creator .. ":token"}) do
+		if redis.call("PTTL", key) < tonumber(ARGV[2]) then
+			redis.call("PEXPIRE", key, ARGV[2])
+		end
+	end
+end
+return 1
+`)
+
+// indexOwnerSessionScript adds session ARGV[3] to the owner's index KEYS[2]
+// if ARGV[1] is the owner token KEYS[1], or claims the owner with the new
+// token ARGV[2] when it has none. Both keys live at least ARGV[4]
+// milliseconds. Returns the owner token, or false for a token mismatch.
+var indexOwnerSessionScript = redis.NewScript(`
+local token = redis.call("GET", KEYS[1])
+if not token then
+	token = ARGV[2]
+	redis.call("SET", KEYS[1], token)
+elseif token ~= ARGV[1] then
+	return false
+end
+redis.call("SADD", KEYS[2], ARGV[3])
+for _, key in ipairs(KEYS) do
+	if redis.call("PTTL", key) < tonumber(ARGV[4]) then
+		redis.call("PEXPIRE", key, ARGV[4])
+	end
+end
+return token
+`)
+
+// transferHostScript replaces a session's host token KEYS[1] with ARGV[2] if
+// it is still ARGV[1], keeping its expiry.
+// Returns 0 for an unknown session, -1 for a token mismatch, 1 otherwise.
+var transferHostScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if not current then
+	return 0
+end
+if current ~= ARGV[1] then
+	return -1
+end
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl > 0 then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ttl)
+else
+	redis.call("SET", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// SessionStore reads and writes sessions in Redis
+type SessionStore struct {
+	rdb *redis.Client
+}
+
+func NewSessionStore(rdb *redis.Client) *SessionStore {
+	return &SessionStore{rdb: rdb}
+}
+
+// Exists reports whether the session is live
+func (s *SessionStore) Exists(ctx context.Context, sessionID string) (bool, error) {
+	n, err := s.rdb.Exists(ctx, Key(sessionID, "")).Result()
+	return n == 1, err
+}
+
+// TTL returns how long the session has left, 0 if it has expired or doesn't expire
+func (s *SessionStore) TTL(ctx context.Context, sessionID string) (time.Duration, error) {
+	ttl, err := s.rdb.PTTL(ctx, Key(sessionID, "")).Result()
+	if err != nil || ttl < 0 {
+		return 0, err
+	}
+	return ttl, nil
+}
+
+// CreateSession stores a new session with its host token and initial state
+// in one step, reporting false without touching anything if the ID is
+// already taken
+func (s *SessionStore) CreateSession(ctx context.Context, sessionID, hostToken string, ttl time.Duration) (bool, error) {
+	state, err := json.Marshal(InitialState(time.Now()))
+	if err != nil {
+		return false, err
+	}
+	created, err := createSessionScript.Run(ctx, s.rdb,
+		[]string{Key(sessionID, ""), Key(sessionID, Host), Key(sessionID, State), activeSessionsKey},
+		hostToken, state, ttl.Milliseconds(), sessionID, time.Now().Add(ttl).UnixMilli(),
+	).Int()
+	return created == 1, err
+}
+
+// Delete removes the session and all its parts
+func (s *SessionStore) Delete(ctx context.Context, sessionID string) error {
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, Keys(sessionID)...)
+		pipe.ZRem(ctx, activeSessionsKey, sessionID)
+		return nil
+	})
+	return err
+}
+
+// CountActive returns the number of live sessions, dropping expired ones
+// from the index on the way
+func (s *SessionStore) CountActive(ctx context.Context) (int64, error) {
+	var count *redis.IntCmd
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, activeSessionsKey, "-inf", strconv.FormatInt(time.Now().UnixMilli(), 10))
+		count = pipe.ZCard(ctx, activeSessionsKey)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+// GetState returns the session's playback state, redis.Nil when it has none
+func (s *SessionStore) GetState(ctx context.Context, sessionID string) (PlaybackState, error) {
+	var state PlaybackState
+	val, err := s.rdb.Get(ctx, Key(sessionID, State)).Bytes()
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(val, &state)
+	return state, err
+}
+
+// SetState stores the session's playback state and extends the life of the
+// whole session to ttl, so an active session doesn't expire. It reports false
+// and stores nothing when the session has already expired.
+func (s *SessionStore) SetState(ctx context.Context, sessionID string, state PlaybackState, ttl time.Duration) (bool, error) {
+	val, err := json.Marshal(state)
+	if err != nil {
+		return false, err
+	}
+	// The state, meta and active sessions keys go second to fourth, as the
+	// script expects
+	keys := []string{Key(sessionID, ""), Key(sessionID, State), Key(sessionID, Meta), activeSessionsKey}
+	for _, part := range parts {
+		if part != State && part != Meta {
+			keys = append(keys, Key(sessionID, part))
+		}
+	}
+	live, err := setStateScript.Run(ctx, s.rdb, keys, val, ttl.Milliseconds(), ownerPrefix,
+		sessionID, time.Now().Add(ttl).UnixMilli()).Int()
+	return live == 1, err
+}
+
+// IndexOwnerSession lists the session under its creator for as long as ttl
+// or the creator's other sessions live. ownerToken must be the creator's
+// token, unless the creator has none yet and newToken becomes it. Returns the
+// creator's token, or ErrInvalidOwnerToken.
+func (s *SessionStore) IndexOwnerSession(ctx context.Context, creator, sessionID, ownerToken, newToken string, ttl time.Duration) (string, error) {
+	token, err := indexOwnerSessionScript.Run(ctx, s.rdb,
+		[]string{OwnerTokenKey(creator), OwnerSessionsKey(creator)},
+		ownerToken, newToken, sessionID, ttl.Milliseconds(),
+	).Text()
+	if err == redis.Nil {
+		return "", ErrInvalidOwnerToken
+	}
+	return token, err
+}
+
+// ValidateOwner reports whether ownerToken is creator's owner token
+func (s *SessionStore) ValidateOwner(ctx context.Context, creator, ownerToken string) (bool, error) {
+	stored, err := s.rdb.Get(ctx, OwnerTokenKey(creator)).Result()
+	if err == redis.Nil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return ownerToken != "" && subtle.ConstantTimeCompare([]byte(stored), []byte(ownerToken)) == 1, nil
+}
+
+// ValidateHost reports whether hostToken is the session's current host
+// token, with ErrSessionNotFound when the session has none
+func (s *SessionStore) ValidateHost(ctx context.Context, sessionID, hostToken string) (bool, error) {
+	stored, err := s.rdb.Get(ctx, Key(sessionID, Host)).Result()
+	if err == redis.Nil {
+		return false, ErrSessionNotFound
+	} else if err != nil {
+		return false, err
+	}
+	return hostToken != "" && subtle.ConstantTimeCompare([]byte(stored), []byte(hostToken)) == 1, nil
+}
+
+// TransferHost replaces the host token if it is still oldToken, failing with
+// ErrSessionNotFound or ErrInvalidHostToken otherwise
+func (s *SessionStore) TransferHost(ctx context.Context, sessionID, oldToken, newToken string) error {
+	result, err := transferHostScript.Run(ctx, s.rdb, []string{Key(sessionID, Host)}, oldToken, newToken).Int()
+	if err != nil {
+		return err
+	}
+	switch result {
+	case 0:
+		return ErrSessionNotFound
+	case -1:
+		return ErrInvalidHostToken
+	}
+	return nil
+}
+
+// AssignedServer returns the ID of the session's streaming server, "" if none
+func (s *SessionStore) AssignedServer(ctx context.Context, sessionID string) (string, error) {
+	serverID, err := s.rdb.Get(ctx, Key(sessionID, Server)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return serverID, err
+}
+
+// AssignServer records serverID as the session's streaming server for as
+// long as the session lives, and returns the server that ends up assigned.
+// With replace it overwrites any assignment, otherwise the first assignment
+// wins and concurrent callers all get its server.
+func (s *SessionStore) AssignServer(ctx context.Context, sessionID, serverID string, replace bool, fallbackTTL time.Duration) (string, error) {
+	ttl, err := s.TTL(ctx, sessionID)
+	if err != nil || ttl <= 0 {
+		ttl = fallbackTTL
+	}
+	key := Key(sessionID, Server)
+	if replace {
+		return serverID, s.rdb.Set(ctx, key, serverID, ttl).Err()
+	}
+
+	set, err := s.rdb.SetNX(ctx, key, serverID, ttl).Result()
+	if err != nil || set {
+		return serverID, err
+	}
+	return s.rdb.Get(ctx, key).Result()
+}
+
+// Publish sends a message to the clients of the session on every streaming server
+func (s *SessionStore) Publish(ctx context.Context, sessionID string, payload []byte) error {
+	return s.rdb.Publish(ctx, UpdatesChannel(sessionID), string(payload)).Err()
+}
+
+// Subscribe receives the messages published to the session
+func (s *SessionStore) Subscribe(ctx context.Context, sessionID string) *redis.PubSub {
+	return s.rdb.Subscribe(ctx, UpdatesChannel(sessionID))
+}
@@ -0,0 +1,253 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+var ctx = context.Background()
+
+func newTestStore(t *testing.T) (*SessionStore, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return NewSessionStore(rdb), mr
+}
+
+func TestKeyLayout(t *testing.T) {
+	const id = "0b3c9a4e-6f52-4d9e-9a51-3f2b8c7d1e00"
+	if got := Key(id, ""); got != "session:"+id {
+		t.Errorf("Key(id, \"\") = %q", got)
+	}
+	if got := Key(id, State); got != "session:"+id+":state" {
+		t.Errorf("Key(id, State) = %q", got)
+	}
+	if got := JoinKey(id, "tok"); got != "session:"+id+":join:tok" {
+		t.Errorf("JoinKey = %q", got)
+	}
+	if got := UpdatesChannel(id); got != "session-updates:"+id {
+		t.Errorf("UpdatesChannel = %q", got)
+	}
+	if got, ok := SessionFromChannel(UpdatesChannel(id)); !ok || got != id {
+		t.Errorf("SessionFromChannel = %q, %v", got, ok)
+	}
+	if _, ok := SessionFromChannel("server-reassign"); ok {
+		t.Error("SessionFromChannel accepted a foreign channel")
+	}
+
+	keys := Keys(id)
+	if len(keys) != len(parts)+1 || keys[0] != Key(id, "") {
+		t.Fatalf("Keys = %v", keys)
+	}
+	for i, part := range parts {
+		if keys[i+1] != Key(id, part) {
+			t.Errorf("Keys[%d] = %q, want %q", i+1, keys[i+1], Key(id, part))
+		}
+	}
+}
+
+func TestCreateSession(t *testing.T) {
+	s, mr := newTestStore(t)
+
+	created, err := s.CreateSession(ctx, "a", "host-token", time.Hour)
+	if err != nil || !created {
+		t.Fatalf("CreateSession = %v, %v", created, err)
+	}
+	for _, key := range []string{Key("a", ""), Key("a", Host), Key("a", State)} {
+		if ttl := mr.TTL(key); ttl != time.Hour {
+			t.Errorf("TTL of %s = %v, want 1h", key, ttl)
+		}
+	}
+	state, err := s.GetState(ctx, "a")
+	if err != nil || !state.Paused || state.PlaybackRate != 1 {
+		t.Errorf("initial state = %+v, %v", state, err)
+	}
+
+	// A taken ID is left untouched
+	created, err = s.CreateSession(ctx, "a", "other-token", time.Hour)
+	if err != nil || created {
+		t.Fatalf("CreateSession of a taken ID = %v, %v", created, err)
+	}
+	if ok, _ := s.ValidateHost(ctx, "a", "host-token"); !ok {
+		t.Error("host token was replaced")
+	}
+}
+
+func TestSetStateSlidesTTL(t *testing.T) {
+	s, mr := newTestStore(t)
+	s.CreateSession(ctx, "a", "host-token", time.Hour)
+	mr.HSet(Key("a", Meta), "creator", "alice")
+	mr.SetTTL(Key("a", Meta), time.Hour)
+	mr.FastForward(30 * time.Minute)
+
+	live, err := s.SetState(ctx, "a", PlaybackState{CurrentTime: 5, PlaybackRate: 1, Timestamp: 1}, 2*time.Hour)
+	if err != nil || !live {
+		t.Fatalf("SetState = %v, %v", live, err)
+	}
+	for _, key := range []string{Key("a", ""), Key("a", Host), Key("a", State), Key("a", Meta)} {
+		if ttl := mr.TTL(key); ttl != 2*time.Hour {
+			t.Errorf("TTL of %s = %v, want 2h", key, ttl)
+		}
+	}
+	// Parts that don't exist aren't created by the slide
+	if mr.Exists(Key("a", Chat)) {
+		t.Error("SetState created the chat key")
+	}
+
+	// Once the session is gone a late update doesn't bring it back
+	mr.FastForward(3 * time.Hour)
+	live, err = s.SetState(ctx, "a", PlaybackState{Timestamp: 2}, time.Hour)
+	if err != nil || live {
+		t.Fatalf("SetState of an expired session = %v, %v", live, err)
+	}
+	if mr.Exists(Key("a", State)) {
+		t.Error("SetState recreated the state of an expired session")
+	}
+}
+
+func TestStateTimestamps(t *testing.T) {
+	before := time.Now().UnixMilli()
+	state := InitialState(time.Now())
+	if state.Timestamp < before || state.Timestamp > time.Now().UnixMilli() {
+		t.Errorf("InitialState timestamp %d isn't in milliseconds", state.Timestamp)
+	}
+
+	s, _ := newTestStore(t)
+	s.CreateSession(ctx, "a", "host-token", time.Hour)
+	initial, _ := s.GetState(ctx, "a")
+	later := PlaybackState{CurrentTime: 10, PlaybackRate: 1, Timestamp: initial.Timestamp + 1000}
+	if _, err := s.SetState(ctx, "a", later, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.GetState(ctx, "a")
+	if err != nil || stored != later {
+		t.Errorf("GetState = %+v, %v, want %+v", stored, err, later)
+	}
+	if stored.Timestamp <= initial.Timestamp {
+		t.Error("stored timestamp didn't move forward")
+	}
+
+	if _, err := s.GetState(ctx, "missing"); err != redis.Nil {
+		t.Errorf("GetState of a missing session = %v, want redis.Nil", err)
+	}
+}
+
+func TestHostValidation(t *testing.T) {
+	s, _ := newTestStore(t)
+	s.CreateSession(ctx, "a", "host-token", time.Hour)
+
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{"host-token", true},
+		{"wrong", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if ok, err := s.ValidateHost(ctx, "a", tt.token); err != nil || ok != tt.want {
+			t.Errorf("ValidateHost(%q) = %v, %v, want %v", tt.token, ok, err, tt.want)
+		}
+	}
+	if _, err := s.ValidateHost(ctx, "missing", "host-token"); err != ErrSessionNotFound {
+		t.Errorf("ValidateHost of a missing session = %v, want ErrSessionNotFound", err)
+	}
+
+	if err := s.TransferHost(ctx, "a", "wrong", "new"); err != ErrInvalidHostToken {
+		t.Errorf("TransferHost with a wrong token = %v", err)
+	}
+	if err := s.TransferHost(ctx, "a", "host-token", "new"); err != nil {
+		t.Fatalf("TransferHost = %v", err)
+	}
+	if ok, _ := s.ValidateHost(ctx, "a", "host-token"); ok {
+		t.Error("old host token still valid")
+	}
+	if ok, _ := s.ValidateHost(ctx, "a", "new"); !ok {
+		t.Error("new host token not valid")
+	}
+	if err := s.TransferHost(ctx, "missing", "x", "y"); err != ErrSessionNotFound {
+		t.Errorf("TransferHost of a missing session = %v", err)
+	}
+}
+
+func TestOwnerIndex(t *testing.T) {
+	s, mr := newTestStore(t)
+
+	token, err := s.IndexOwnerSession(ctx, "alice", "a", "", "owner-token", time.Hour)
+	if err != nil || token != "owner-token" {
+		t.Fatalf("claiming the owner = %q, %v", token, err)
+	}
+	if _, err := s.IndexOwnerSession(ctx, "alice", "b", "wrong", "other", time.Hour); err != ErrInvalidOwnerToken {
+		t.Errorf("indexing with a wrong token = %v", err)
+	}
+	if token, err := s.IndexOwnerSession(ctx, "alice", "b", "owner-token", "other", time.Hour); err != nil || token != "owner-token" {
+		t.Errorf("indexing with the token = %q, %v", token, err)
+	}
+	members, _ := mr.Members(OwnerSessionsKey("alice"))
+	if len(members) != 2 {
+		t.Errorf("owner index = %v", members)
+	}
+
+	if ok, _ := s.ValidateOwner(ctx, "alice", "owner-token"); !ok {
+		t.Error("owner token not valid")
+	}
+	if ok, _ := s.ValidateOwner(ctx, "alice", ""); ok {
+		t.Error("empty owner token valid")
+	}
+	if ok, _ := s.ValidateOwner(ctx, "bob", "owner-token"); ok {
+		t.Error("owner token valid for another creator")
+	}
+}
+
+func TestCountActive(t *testing.T) {
+	s, _ := newTestStore(t)
+	s.CreateSession(ctx, "a", "t", time.Hour)
+	s.CreateSession(ctx, "b", "t", time.Hour)
+	s.CreateSession(ctx, "c", "t", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	if n, err := s.CountActive(ctx); err != nil || n != 2 {
+		t.Errorf("CountActive = %d, %v, want 2", n, err)
+	}
+	s.Delete(ctx, "a")
+	if n, _ := s.CountActive(ctx); n != 1 {
+		t.Errorf("CountActive after Delete = %d, want 1", n)
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	s, _ := newTestStore(t)
+
+	sub := s.Subscribe(ctx, "a")
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil { // subscription confirmation
+		t.Fatal(err)
+	}
+	other := s.Subscribe(ctx, "b")
+	defer other.Close()
+	if _, err := other.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Publish(ctx, "a", []byte(`{"type":"chat"}`)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-sub.Channel():
+		if msg.Channel != UpdatesChannel("a") || msg.Payload != `{"type":"chat"}` {
+			t.Errorf("received %s on %s", msg.Payload, msg.Channel)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+	}
+	select {
+	case msg := <-other.Channel():
+		t.Errorf("other session received %s", msg.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+)
+
+// Clients report playback stalls with
+//
+//	{"type": "bufferingReport", "stalled": true, "bufferLevel": 0.4}
+//
+// where bufferLevel is the seconds of video buffered ahead of the playhead.
+// Only a change between stalled and playing counts; repeated reports of the
+// same state just update the buffer level. The host and co-hosts are sent
+//
+//	{"type": "bufferingStatus", "stalledViewers": 2, "viewers": 5, "stalls": 7}
+//
+// whenever the number of stalled viewers changes, at most once every
+// BUFFERING_NOTIFY_INTERVAL, so they can pause until everyone catches up.
+
+const BUFFERING_NOTIFY_INTERVAL = 500 * time.Millisecond
+
+// sessionBuffering holds a session's stall count and throttles the status
+// sent to its controllers
+type sessionBuffering struct {
+	mu       sync.Mutex
+	stalls   int64 // stalls reported since the session's first client joined here
+	lastSent time.Time
+	timer    *time.Timer // pending trailing notification
+}
+
+// BufferingSummary is a session's buffering state, sent to its controllers
+// and reported on /status
+type BufferingSummary struct {
+	Stalls         int64   `json:"stalls"`
+	StalledViewers int     `json:"stalledViewers"`
+	Viewers        int     `json:"viewers"`
+	MinBufferLevel float64 `json:"minBufferLevel"` // seconds, lowest among viewers
+}
+
+var (
+	buffering      = make(map[string]*sessionBuffering)
+	buffering_lock sync.Mutex
+)
+
+// handleBufferingReport records a client's playback state and tells the
+// session's controllers when the number of stalled viewers changed
+func handleBufferingReport(client *ClientConnection, stalled bool, bufferLevel float64) {
+	if math.IsNaN(bufferLevel) || math.IsInf(bufferLevel, 0) || bufferLevel < 0 {
+		bufferLevel = 0
+	}
+	client.bufferLevel.Store(math.Float64bits(bufferLevel))
+	if client.stalled.Swap(stalled) == stalled {
+		return
+	}
+
+	b := bufferingFor(client.sessionID)
+	if stalled {
+		b.mu.Lock()
+		b.stalls++
+		b.mu.Unlock()
+		playbackStalls.Inc()
+	}
+	b.notify(client.sessionID)
+}
+
+func bufferingFor(sessionID string) *sessionBuffering {
+	buffering_lock.Lock()
+	defer buffering_lock.Unlock()
+
+	b, ok := buffering[sessionID]
+	if !ok {
+		b = &sessionBuffering{}
+		buffering[sessionID] = b
+	}
+	return b
+}
+
+// notify sends the session's buffering status to its controllers now, or
+// once the interval since the last one has passed
+func (b *sessionBuffering) notify(sessionID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.timer != nil {
+		// The pending notification will pick up this change
+		return
+	}
+	wait := BUFFERING_NOTIFY_INTERVAL - time.Since(b.lastSent)
+	if wait <= 0 {
+		b.lastSent = time.Now()
+		go sendBufferingStatus(sessionID)
+		return
+	}
+	b.timer = time.AfterFunc(wait, func() {
+		b.mu.Lock()
+		b.timer = nil
+		b.lastSent = time.Now()
+		b.mu.Unlock()
+		sendBufferingStatus(sessionID)
+	})
+}
+
+// sendBufferingStatus sends the session's buffering summary to its host and co-hosts
+func sendBufferingStatus(sessionID string) {
+	summary, ok := bufferingSummary(sessionID)
+	if !ok {
+		return
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"type":           "bufferingStatus",
+		"stalls":         summary.Stalls,
+		"stalledViewers": summary.StalledViewers,
+		"viewers":        summary.Viewers,
+		"minBufferLevel": summary.MinBufferLevel,
+	})
+	if err != nil {
+		return
+	}
+
+	for _, c := range clients.clients(sessionID) {
+		if !c.canControl() {
+			continue
+		}
+		select {
+		case c.send <- payload:
+		default:
+			c.log.Warn("Dropping buffering status, send buffer full")
+		}
+	}
+}
+
+// bufferingSummary totals the buffering state of a session's local clients.
+// Controllers aren't counted as viewers.
+func bufferingSummary(sessionID string) (BufferingSummary, bool) {
+	buffering_lock.Lock()
+	b, ok := buffering[sessionID]
+	buffering_lock.Unlock()
+	if !ok {
+		return BufferingSummary{}, false
+	}
+
+	var summary BufferingSummary
+	b.mu.Lock()
+	summary.Stalls = b.stalls
+	b.mu.Unlock()
+
+	summary.MinBufferLevel = math.Inf(1)
+	for _, c := range clients.clients(sessionID) {
+		if c.canControl() {
+			continue
+		}
+		summary.Viewers++
+		if c.stalled.Load() {
+			summary.StalledViewers++
+		}
+		summary.MinBufferLevel = min(summary.MinBufferLevel, math.Float64frombits(c.bufferLevel.Load()))
+	}
+	if summary.Viewers == 0 {
+		summary.MinBufferLevel = 0
+	}
+	return summary, true
+}
+
+// allBufferingSummaries returns the buffering summary of every session that
+// has reported buffering
+func allBufferingSummaries() map[string]BufferingSummary {
+	buffering_lock.Lock()
+	ids := make([]string, 0, len(buffering))
+	for id := range buffering {
+		ids = append(ids, id)
+	}
+	buffering_lock.Unlock()
+
+	summaries := make(map[string]BufferingSummary, len(ids))
+	for _, id := range ids {
+		if summary, ok := bufferingSummary(id); ok {
+			summaries[id] = summary
+		}
+	}
+	return summaries
+}
+
+// clientLeftBuffering updates the session's controllers when a stalled client
+// leaves, and forgets the session once its last client has gone
+func clientLeftBuffering(client *ClientConnection) {
+	if len(clients.clients(client.sessionID)) == 0 {
+		buffering_lock.Lock()
+		if b, ok := buffering[client.sessionID]; ok {
+			b.mu.Lock()
+			if b.timer != nil {
+				b.timer.Stop()
+			}
+			b.mu.Unlock()
+			delete(buffering, client.sessionID)
+		}
+		buffering_lock.Unlock()
+		return
+	}
+	if client.stalled.Load() {
+		bufferingFor(client.sessionID).notify(client.sessionID)
+	}
+}
+
+// stalledClients counts the clients on this server that are currently stalled
+func stalledClients() int {
+	n := 0
+	for _, id := range clients.sessionIDs() {
+		for _, c := range clients.clients(id) {
+			if c.stalled.Load() {
+				n++
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	wsConnections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "videosync_websocket_connections_total",
+		Help: "WebSocket connections accepted.",
+	})
+	wsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "videosync_websocket_rejected_total",
+		Help: "WebSocket connections refused with 503, by reason (capacity or draining).",
+	}, []string{"reason"})
+	stateUpdates = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "videosync_state_updates_total",
+		Help: "Playback state updates persisted and published.",
+	})
+	redisErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "videosync_redis_errors_total",
+		Help: "Failed Redis commands.",
+	})
+	playbackStalls = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "videosync_playback_stalls_total",
+		Help: "Playback stalls reported by clients.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "videosync_stalled_clients",
+		Help: "Clients whose playback is currently stalled.",
+	}, func() float64 {
+		return float64(stalledClients())
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "videosync_websocket_clients",
+		Help: "WebSocket clients connected to this server.",
+	}, func() float64 {
+		numClients_lock.Lock()
+		defer numClients_lock.Unlock()
+		return float64(numClients)
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "videosync_load_ratio",
+		Help: "Connected clients as a fraction of this server's capacity.",
+	}, func() float64 {
+		numClients_lock.Lock()
+		defer numClients_lock.Unlock()
+		return float64(numClients) / float64(capacity)
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "videosync_local_sessions",
+		Help: "Sessions with at least one client on this server.",
+	}, func() float64 {
+		subscriptions_lock.Lock()
+		defer subscriptions_lock.Unlock()
+		return float64(len(subscriptions))
+	})
+)
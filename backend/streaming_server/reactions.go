@@ -0,0 +1,84 @@
+package main
+
+import "time"
+
+// Clients send a reaction with
+//
+//	{"type": "reaction", "reaction": "heart"}
+//
+// and every participant receives
+//
+//	{"type": "reaction", "participantId": "...", "name": "...", "reaction": "heart", "timestamp": <ms>}
+//
+// to float over the video. Unlike chat, reactions aren't kept in the session
+// history. Each clientId may send REACTION_LIMIT of them per REACTION_WINDOW
+// across all its connections to the session, and each connection without a
+// clientId as many; the rest are dropped.
+
+const (
+	REACTION_LIMIT  = 5
+	REACTION_WINDOW = 3 * time.Second
+)
+
+// The reactions clients can send, the frontend maps them onto emoji
+var allowedReactions = map[string]bool{
+	"heart":  true, // ❤️
+	"laugh":  true, // 😂
+	"clap":   true, // 👏
+	"wow":    true, // 😮
+	"sad":    true, // 😢
+	"fire":   true, // 🔥
+	"thumbs": true, // 👍
+	"party":  true, // 🎉
+}
+
+// Reaction is relayed to every participant and not stored
+type Reaction struct {
+	Type          string `json:"type"`
+	ParticipantID string `json:"participantId"`
+	Name          string `json:"name"`
+	Reaction      string `json:"reaction"`
+	Timestamp     int64  `json:"timestamp"` // server time in milliseconds
+}
+
+// reactionLimiter allows REACTION_LIMIT reactions per REACTION_WINDOW. It has
+// no lock, the registry guards the ones shared by a clientID and a
+// connection's own is only used from its read loop.
+type reactionLimiter struct {
+	windowStart time.Time
+	count       int
+}
+
+func (l *reactionLimiter) allow(now time.Time) bool {
+	if now.Sub(l.windowStart) >= REACTION_WINDOW {
+		l.windowStart = now
+		l.count = 0
+	}
+	if l.count >= REACTION_LIMIT {
+		return false
+	}
+	l.count++
+	return true
+}
+
+// handleReaction broadcasts an allowed reaction to the session's participants
+func handleReaction(client *ClientConnection, reaction string) {
+	if !allowedReactions[reaction] {
+		client.log.Warn("Dropping unknown reaction", "bytes", len(reaction))
+		return
+	}
+	now := time.Now()
+	if !clients.allowReaction(client, now) {
+		// Debug only, a flooding client would flood the log too
+		client.log.Debug("Dropping reaction, rate limit reached")
+		return
+	}
+
+	publishSessionMessage(client.sessionID, Reaction{
+		Type:          "reaction",
+		ParticipantID: client.id,
+		Name:          client.name,
+		Reaction:      reaction,
+		Timestamp:     now.UnixMilli(),
+	})
+}
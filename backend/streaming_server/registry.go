@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// SessionRegistry holds the local WebSocket clients of each session. All
+// methods are safe for concurrent use, lookups return snapshots.
+type SessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[string][]*ClientConnection
+
+	// Reaction limits per session and clientID, shared by all of a
+	// browser's connections and forgotten with the session
+	reactions map[string]map[string]*reactionLimiter
+}
+
+func newSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		sessions:  make(map[string][]*ClientConnection),
+		reactions: make(map[string]map[string]*reactionLimiter),
+	}
+}
+
+// addLimited registers a client under its session, keeping at most max open
+// connections with its clientID in the session. It marks the oldest ones
+// beyond that as replaced and returns them for the caller to close; they
+// stay registered until cleanupClient removes them.
+func (r *SessionRegistry) addLimited(client *ClientConnection, max int) []*ClientConnection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var replaced []*ClientConnection
+	if client.clientID != "" {
+		var same []*ClientConnection
+		for _, c := range r.sessions[client.sessionID] {
+			if c.clientID == client.clientID && !c.replaced.Load() {
+				same = append(same, c)
+			}
+		}
+		// Clients are appended as they connect, so the oldest come first
+		if excess := len(same) + 1 - max; excess > 0 {
+			replaced = same[:excess]
+			for _, c := range replaced {
+				c.replaced.Store(true)
+			}
+		}
+	}
+	r.sessions[client.sessionID] = append(r.sessions[client.sessionID], client)
+	return replaced
+}
+
+// remove unregisters a client, reporting whether it was registered. A session
+// is forgotten with its last client.
+func (r *SessionRegistry) remove(client *ClientConnection) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessionClients := r.sessions[client.sessionID]
+	for i, c := range sessionClients {
+		if c != client {
+			continue
+		}
+		if len(sessionClients) == 1 {
+			delete(r.sessions, client.sessionID)
+			delete(r.reactions, client.sessionID)
+		} else {
+			// Copy rather than shift in place, snapshots may share the array
+			remaining := make([]*ClientConnection, 0, len(sessionClients)-1)
+			remaining = append(remaining, sessionClients[:i]...)
+			r.sessions[client.sessionID] = append(remaining, sessionClients[i+1:]...)
+		}
+		return true
+	}
+	return false
+}
+
+// allowReaction reports whether the client may send another reaction now.
+// Connections of the same clientID share one limit, so opening more of them
+// doesn't raise it; a connection without a clientID has its own.
+func (r *SessionRegistry) allowReaction(client *ClientConnection, now time.Time) bool {
+	if client.clientID == "" {
+		return client.reactions.allow(now)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	limiters := r.reactions[client.sessionID]
+	if limiters == nil {
+		limiters = make(map[string]*reactionLimiter)
+		r.reactions[client.sessionID] = limiters
+	}
+	limiter := limiters[client.clientID]
+	if limiter == nil {
+		limiter = &reactionLimiter{}
+		limiters[client.clientID] = limiter
+	}
+	return limiter.allow(now)
+}
+
+// clients returns the session's clients
+func (r *SessionRegistry) clients(sessionID string) []*ClientConnection {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sessionClients := r.sessions[sessionID]
+	snapshot := make([]*ClientConnection, len(sessionClients))
+	copy(snapshot, sessionClients)
+	return snapshot
+}
+
+// find returns the session's client with the given participant ID, or nil
+func (r *SessionRegistry) find(sessionID, id string) *ClientConnection {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, c := range r.sessions[sessionID] {
+		if c.id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// sessionIDs returns the sessions that have local clients
+func (r *SessionRegistry) sessionIDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]string, 0, len(r.sessions))
+	for id := range r.sessions {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// counts returns the number of local clients of each session
+func (r *SessionRegistry) counts() map[string]int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	counts := make(map[string]int, len(r.sessions))
+	for id, sessionClients := range r.sessions {
+		counts[id] = len(sessionClients)
+	}
+	return counts
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionRegistryConcurrent(t *testing.T) {
+	r := newSessionRegistry()
+	const sessions, perSession = 40, 100
+
+	var wg sync.WaitGroup
+	for s := 0; s < sessions; s++ {
+		sessionID := "session-" + strconv.Itoa(s)
+		added := make(chan *ClientConnection, perSession)
+
+		// Clients join the session, sharing a few clientIds so some
+		// replace each other
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(added)
+			for i := 0; i < perSession; i++ {
+				c := fakeClient(sessionID)
+				c.clientID = "client-" + strconv.Itoa(i%4)
+				r.addLimited(c, maxConnectionsPerClient)
+				r.allowReaction(c, time.Now())
+				added <- c
+			}
+		}()
+
+		// and leave it again
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range added {
+				if !r.remove(c) {
+					t.Errorf("client %s wasn't registered", c.id)
+				}
+			}
+		}()
+
+		// while the session is broadcast to and looked up
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perSession; i++ {
+				for _, c := range r.clients(sessionID) {
+					if c.replaced.Load() {
+						continue
+					}
+					select {
+					case c.send <- []byte(`{"type":"chat"}`):
+					default:
+					}
+					r.find(sessionID, c.id)
+				}
+				r.counts()
+				r.sessionIDs()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if counts := r.counts(); len(counts) != 0 {
+		t.Errorf("registry not empty after every client left: %v", counts)
+	}
+	if ids := r.sessionIDs(); len(ids) != 0 {
+		t.Errorf("sessions left after every client left: %v", ids)
+	}
+}
+
+func TestSessionRegistryAddLimited(t *testing.T) {
+	r := newSessionRegistry()
+	var conns []*ClientConnection
+	for i := 0; i < 3; i++ {
+		c := fakeClient("a")
+		c.clientID = "browser"
+		if replaced := r.addLimited(c, 2); i < 2 && len(replaced) != 0 {
+			t.Fatalf("connection %d replaced %d others under the limit", i, len(replaced))
+		} else if i == 2 && (len(replaced) != 1 || replaced[0] != conns[0]) {
+			t.Fatalf("third connection replaced %v, want the oldest", replaced)
+		}
+		conns = append(conns, c)
+	}
+	if !conns[0].replaced.Load() || conns[1].replaced.Load() {
+		t.Error("wrong connection marked replaced")
+	}
+
+	// Snapshots aren't affected by later removals
+	snapshot := r.clients("a")
+	r.remove(conns[1])
+	if len(snapshot) != 3 || snapshot[1] != conns[1] {
+		t.Error("remove changed an earlier snapshot")
+	}
+	if got := r.counts()["a"]; got != 2 {
+		t.Errorf("count = %d, want 2", got)
+	}
+}
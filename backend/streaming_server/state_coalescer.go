@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// A host scrubbing the timeline can send many stateUpdates a second. Rather
+// than writing and publishing every one, the newest state of each session is
+// flushed at most once per stateFlushInterval. Play/pause changes are flushed
+// right away so they can't be merged away, and a trailing flush stores the
+// position the scrub ended on. Seeks are also flushed right away, as a seek
+// event rather than a stateUpdate so viewers jump instead of correcting.
+// A state that only changes the playback rate is sent as a rateChange, so
+// viewers switch speed without seeking.
+
+// How far a state's position may be from where the stored state would have
+// played to, in seconds, and still count as a rate change only
+const RATE_CHANGE_TOLERANCE = 1.0
+
+type stateCoalescer struct {
+	mu        sync.Mutex
+	pending   *RedisState // newest state waiting for the next flush
+	paused    bool        // paused in the last flushed state
+	flushed   bool        // whether paused is known yet
+	lastFlush time.Time
+	timer     *time.Timer // trailing flush of pending
+}
+
+var (
+	coalescers      = make(map[string]*stateCoalescer)
+	coalescers_lock = &sync.Mutex{}
+)
+
+// queueStateUpdate stores and publishes a controller's state now or with
+// the session's next flush
+func queueStateUpdate(sessionID string, state RedisState) {
+	if stateFlushInterval <= 0 {
+		persistState(sessionID, state, "stateUpdate")
+		return
+	}
+
+	c := coalescerFor(sessionID)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending != nil && state.Timestamp <= c.pending.Timestamp {
+		return
+	}
+	sinceFlush := time.Since(c.lastFlush)
+	if (c.flushed && state.Paused != c.paused) || sinceFlush >= stateFlushInterval {
+		c.flush(sessionID, state, "stateUpdate")
+		return
+	}
+
+	c.pending = &state
+	if c.timer == nil {
+		c.timer = time.AfterFunc(stateFlushInterval-sinceFlush, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.timer = nil
+			if c.pending != nil {
+				c.flush(sessionID, *c.pending, "stateUpdate")
+			}
+		})
+	}
+}
+
+// queueSeek stores a seek right away, replacing any pending state, and sends
+// viewers a seek event
+func queueSeek(sessionID string, state RedisState) {
+	c := coalescerFor(sessionID)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending != nil && state.Timestamp <= c.pending.Timestamp {
+		return
+	}
+	c.flush(sessionID, state, "seek")
+}
+
+// coalescerFor returns the session's coalescer, creating it if needed
+func coalescerFor(sessionID string) *stateCoalescer {
+	coalescers_lock.Lock()
+	defer coalescers_lock.Unlock()
+
+	c, exists := coalescers[sessionID]
+	if !exists {
+		c = &stateCoalescer{}
+		coalescers[sessionID] = c
+	}
+	return c
+}
+
+// flush persists state in place of anything pending, broadcasting it as an
+// event of type event. c.mu must be held.
+func (c *stateCoalescer) flush(sessionID string, state RedisState, event string) {
+	c.pending = nil
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.lastFlush = time.Now()
+	if persistState(sessionID, state, event) {
+		c.paused = state.Paused
+		c.flushed = true
+	}
+}
+
+// flushPendingState writes out the session's pending state, if any, and
+// forgets the session. Called on shutdown.
+func flushPendingState(sessionID string) {
+	if c := takeCoalescer(sessionID); c != nil {
+		c.flushPending(sessionID)
+	}
+}
+
+// takeCoalescer forgets the session's coalescer and returns it, nil if it has
+// none, so updates from now on start a new one
+func takeCoalescer(sessionID string) *stateCoalescer {
+	coalescers_lock.Lock()
+	defer coalescers_lock.Unlock()
+
+	c := coalescers[sessionID]
+	delete(coalescers, sessionID)
+	return c
+}
+
+// flushPending writes out the state waiting for the next flush, if any
+func (c *stateCoalescer) flushPending(sessionID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending != nil {
+		c.flush(sessionID, *c.pending, "stateUpdate")
+	}
+}
+
+// flushAllPendingStates flushes every session's pending state
+func flushAllPendingStates() {
+	coalescers_lock.Lock()
+	sessionIDs := make([]string, 0, len(coalescers))
+	for sessionID := range coalescers {
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	coalescers_lock.Unlock()
+
+	for _, sessionID := range sessionIDs {
+		flushPendingState(sessionID)
+	}
+}
+
+// persistState saves state and publishes it to the session if it's newer than
+// the stored one, returning whether it was. A "seek" event is published as a
+// typed seek message, a state that only changes the rate as a rateChange and
+// anything else as a plain state update.
+func persistState(sessionID string, state RedisState, event string) bool {
+	stateFromRedis, err := sessionStore.GetState(ctx, sessionID)
+	if err == redis.Nil {
+		slog.Warn("No stored state for session", "session_id", sessionID)
+		return false
+	} else if err != nil {
+		slog.Error("Error getting state from Redis", "session_id", sessionID, "error", err)
+		return false
+	}
+	if state.Timestamp <= stateFromRedis.Timestamp {
+		return false
+	}
+
+	// Only the known state fields are stored and relayed
+	stateJson, _ := json.Marshal(state)
+	live, err := sessionStore.SetState(ctx, sessionID, state, sessionTTL)
+	if err != nil {
+		slog.Error("Error updating state in Redis", "session_id", sessionID, "error", err)
+		return false
+	} else if !live {
+		slog.Warn("Session expired, dropping state update", "session_id", sessionID)
+		return false
+	}
+
+	if event == "stateUpdate" && isRateChange(stateFromRedis, state) {
+		event = "rateChange"
+	}
+
+	// Publish the state update to all clients in this session
+	if event == "seek" || event == "rateChange" {
+		publishSessionMessage(sessionID, map[string]interface{}{
+			"type":       event,
+			"state":      json.RawMessage(stateJson),
+			"servertime": time.Now().UnixMilli(),
+		})
+	} else {
+		publishStateUpdate(sessionID, stateJson)
+	}
+	stateUpdates.Inc()
+	return true
+}
+
+// isRateChange reports whether next differs from prev only in playback rate:
+// same paused state, and a position where prev would have played to by then
+func isRateChange(prev, next RedisState) bool {
+	if prev.PlaybackRate == next.PlaybackRate || prev.Paused != next.Paused {
+		return false
+	}
+	expected := liveState(prev, time.UnixMilli(next.Timestamp))
+	return math.Abs(next.CurrentTime-expected.CurrentTime) <= RATE_CHANGE_TOLERANCE
+}
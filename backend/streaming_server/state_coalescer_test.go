@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsRateChange(t *testing.T) {
+	stored := time.UnixMilli(1_700_000_000_000)
+	later := stored.Add(10 * time.Second).UnixMilli()
+
+	// Playing at 2x from 30s, so 10s later the room is at 50s
+	prev := RedisState{CurrentTime: 30, PlaybackRate: 2, Timestamp: stored.UnixMilli()}
+	if joined := liveState(prev, time.UnixMilli(later)); joined.CurrentTime != 50 {
+		t.Fatalf("client joining at 2x starts at %v, want 50", joined.CurrentTime)
+	}
+
+	tests := []struct {
+		name string
+		next RedisState
+		want bool
+	}{
+		{"slow down at the playhead", RedisState{CurrentTime: 50, PlaybackRate: 1, Timestamp: later}, true},
+		{"speed up within tolerance", RedisState{CurrentTime: 50.8, PlaybackRate: 3, Timestamp: later}, true},
+		{"playhead assumed at 1x", RedisState{CurrentTime: 40, PlaybackRate: 1, Timestamp: later}, false},
+		{"rate change with a seek", RedisState{CurrentTime: 120, PlaybackRate: 1, Timestamp: later}, false},
+		{"same rate", RedisState{CurrentTime: 50, PlaybackRate: 2, Timestamp: later}, false},
+		{"paused as well", RedisState{Paused: true, CurrentTime: 50, PlaybackRate: 1, Timestamp: later}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRateChange(prev, tt.next); got != tt.want {
+				t.Errorf("isRateChange = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,26 +1,39 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/mayank447/videosync/settings"
+	"github.com/mayank447/videosync/store"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type StreamingServer struct {
@@ -34,96 +47,287 @@ type StreamingServer struct {
 
 type ClientConnection struct {
 	conn      *websocket.Conn
+	id        string // participant ID, unique per connection
+	clientID  string // stable ID the browser sends on every connection, "" if none
+	name      string // display name shown to other participants
 	sessionID string
-	isHost    bool
+	ip        string      // client address, used to keep kicked clients out
+	isHost    atomic.Bool // holds the session's host token, or was handed host control
+	isCoHost  atomic.Bool // set by the host, lets the client control playback
 	send      chan []byte
+	final     chan []byte   // last message before the server closes the socket
+	done      chan struct{} // closed by cleanupClient to stop writePump
+	log       *slog.Logger  // tagged with the request, session and participant IDs
+
+	// Latest bufferingReport, bufferLevel holds float64 bits
+	stalled     atomic.Bool
+	bufferLevel atomic.Uint64
+
+	// Set when a newer connection with the same clientID closed this one
+	replaced atomic.Bool
+
+	reactions reactionLimiter // limit without a clientID, used from the read loop only
+}
+
+// Participant is the public view of a client in presence messages
+type Participant struct {
+	ID       string `json:"participantId"`
+	Name     string `json:"name"`
+	IsHost   bool   `json:"isHost"`
+	IsCoHost bool   `json:"isCoHost"`
+}
+
+// ChatMessage is relayed to every participant and kept in the chat history
+type ChatMessage struct {
+	Type          string `json:"type"`
+	ParticipantID string `json:"participantId"`
+	Name          string `json:"name"`
+	Text          string `json:"text"`
+	Timestamp     int64  `json:"timestamp"` // server time in milliseconds
 }
 
-type RedisState struct {
-	Paused       bool    `json:"paused"`
-	CurrentTime  float64 `json:"currentTime"`
-	PlaybackRate float64 `json:"playbackRate"`
-	Timestamp    int64   `json:"timestamp"`
+type sessionSubscription struct {
+	pubsub *redis.PubSub
+	cancel context.CancelFunc
+	refs   int // number of local clients in the session
 }
 
+// RedisState is a session's playback state as stored, timestamps in milliseconds
+type RedisState = store.PlaybackState
+
 type VideoManifest struct {
-	ChunkDuration int     `json:"chunkDuration"` // Duration in seconds
-	ChunkCount    int     `json:"chunkCount"`
-	VideoDuration float64 `json:"videoDuration"` // Duration in seconds
-	VideoFileType string  `json:"videoFileType"`
+	ChunkDuration int        `json:"chunkDuration"` // Duration in seconds
+	ChunkCount    int        `json:"chunkCount"`
+	VideoDuration float64    `json:"videoDuration"` // Duration in seconds
+	VideoFileType string     `json:"videoFileType"`
+	Qualities     []string   `json:"qualities"`
+	Formats       []string   `json:"formats,omitempty"` // hls and/or dash
+	DASH          string     `json:"dash,omitempty"`    // path of the DASH manifest
+	Poster        string     `json:"poster,omitempty"`  // path of the poster image on the streaming server
+	Subtitles     []Subtitle `json:"subtitles,omitempty"`
+}
+
+// Subtitle is one WebVTT subtitle track of a session's video
+type Subtitle struct {
+	Lang  string `json:"lang"`
+	Label string `json:"label,omitempty"`
+	Path  string `json:"path"` // path of the .vtt file on this server
 }
 
 var (
-	// [TODO] Get the below 4 param through command line
-	mainServerURL = "http://localhost:8080"
+	// [TODO] Get the below 3 param through command line
+	mainServerURL = settings.EnvOr("MAIN_SERVER_URL", "http://localhost:8080")
 	serverID      = os.Getenv("SERVER_ID")
 	serverURL     = os.Getenv("SERVER_URL")
 	serverPort    = os.Getenv("SERVER_PORT")
-	capacity      = 100 // Default capacity
 
-	clients         = make(map[string][]*ClientConnection)
-	client_lock     = make(map[string]*sync.Mutex)
+	// Most WebSocket clients accepted at once, advertised in heartbeats
+	capacity = DEFAULT_CAPACITY
+
+	// Set on shutdown, new WebSocket connections are refused
+	draining atomic.Bool
+
+	startedAt = time.Now()
+
+	// Proves to the main server that registrations and heartbeats for
+	// serverID come from this process
+	serverToken = uuid.New().String()
+
+	clients         = newSessionRegistry()
 	numClients      = 0
 	numClients_lock = &sync.Mutex{}
 
+	// CheckOrigin is set from the origin allowlist in main
 	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true // Allow all origins for now
-		},
 	}
 
-	rdb    *redis.Client
-	pubsub *redis.PubSub
+	// Origins allowed by ALLOWED_ORIGINS, empty allows every origin
+	allowedOrigins []string
+
+	// Proxies whose X-Forwarded-For clientIP believes
+	trustedProxies []*net.IPNet
+
+	rdb *redis.Client
+
+	// Session keys in Redis, see the store package
+	sessionStore *store.SessionStore
+
+	// One Redis subscription per session with local clients
+	subscriptions      = make(map[string]*sessionSubscription)
+	subscriptions_lock = &sync.Mutex{}
 
 	s3Client *s3.Client
 	s3Bucket string
+
+	// HLS delivery: "proxy" streams objects through this server, "presign"
+	// points players straight at S3 with presigned URLs
+	hlsDelivery   string
+	presignClient *s3.PresignClient
+	presignExpiry = DEFAULT_PRESIGN_EXPIRY
+
+	// Sliding session expiry, reset on every persisted state update
+	sessionTTL = REDIS_MSG_EXPIRY
+
+	// Minimum time between stored state updates of a session, 0 stores every one
+	stateFlushInterval = DEFAULT_STATE_FLUSH_INTERVAL
+
+	// Retry budget for registering with the main server
+	registerMaxAttempts = DEFAULT_REGISTER_MAX_ATTEMPTS
+	registerTimeout     = DEFAULT_REGISTER_TIMEOUT
+
+	// Largest WebSocket message a client may send, in bytes
+	maxMessageSize int64 = DEFAULT_MAX_MESSAGE_SIZE
+
+	// Connections one clientID may hold open in a session, older ones are closed
+	maxConnectionsPerClient = DEFAULT_MAX_CONNECTIONS_PER_CLIENT
+
+	// WebSocket keepalive, shortened by tests
+	pongWait   = PONG_WAIT
+	pingPeriod = PING_PERIOD
 )
 
 // HLS directory structure
 const (
 	HLS_PLAYLIST_NAME  = "playlist.m3u8"
 	HLS_MASTER_NAME    = "master.m3u8"
+	HLS_POSTER_NAME    = "poster.jpg"
+	DASH_DIR           = "dash"
+	DASH_MANIFEST_NAME = "manifest.mpd"
 	HEARTBEAT_INTERVAL = 30
 	REDIS_MSG_EXPIRY   = 24 * time.Hour
-	CHUNK_DURATION     = 5
+	REASSIGN_CHANNEL   = "server-reassign"
+	CHUNK_DURATION     = 5 // seconds, for manifests that don't record one
+	MAX_NAME_LENGTH    = 32
+	DEFAULT_NAME       = "Guest"
+	MAX_CHAT_LENGTH    = 500 // characters, longer messages are dropped
+	CHAT_HISTORY_SIZE  = 50  // messages kept in session:{id}:chat
+
+	// Presigned URLs stay valid this long past their segment's position in the video
+	DEFAULT_PRESIGN_EXPIRY = 1 * time.Hour
+	MAX_PRESIGN_EXPIRY     = 7 * 24 * time.Hour // SigV4 limit
+
+	HEALTH_CHECK_TIMEOUT = 2 * time.Second
+
+	// Registration retries back off exponentially between these; attempts and
+	// the overall budget are set with REGISTER_MAX_ATTEMPTS and REGISTER_TIMEOUT
+	REGISTER_INITIAL_BACKOFF      = 1 * time.Second
+	REGISTER_MAX_BACKOFF          = 30 * time.Second
+	DEFAULT_REGISTER_MAX_ATTEMPTS = 10
+	DEFAULT_REGISTER_TIMEOUT      = 5 * time.Minute
+	MAX_HEARTBEAT_FAILURES        = 3 // consecutive failures before registering again
+
+	// Rapid state updates are coalesced, override with STATE_FLUSH_INTERVAL
+	DEFAULT_STATE_FLUSH_INTERVAL = 100 * time.Millisecond
+
+	// WebSocket keepalive
+	PONG_WAIT   = 60 * time.Second   // Time allowed between reads before the client is dropped
+	PING_PERIOD = PONG_WAIT * 9 / 10 // Must be less than PONG_WAIT
+	WRITE_WAIT  = 10 * time.Second   // Time allowed to write a control frame
+
+	// Larger client messages close the socket, override with MAX_MESSAGE_SIZE
+	DEFAULT_MAX_MESSAGE_SIZE = 16 * 1024
+
+	// Clients accepted before new connections get 503, override with CAPACITY
+	DEFAULT_CAPACITY     = 100
+	CAPACITY_RETRY_AFTER = "5" // seconds, sent with the 503
+
+	// Open connections per clientID and session, override with MAX_CONNECTIONS_PER_CLIENT
+	DEFAULT_MAX_CONNECTIONS_PER_CLIENT = 3
+	MAX_CLIENT_ID_LENGTH               = 64
 )
 
 var ctx = context.Background()
 
-func init() {
-	// Initialize AWS S3 client
-	region := os.Getenv("AWS_REGION")
-	s3Bucket = os.Getenv("S3_BUCKET")
-	if region == "" || s3Bucket == "" {
-		log.Fatal("AWS_REGION and S3_BUCKET environment variables must be set")
+func main() {
+	settings.SetupLogging("streaming")
+	cfg := settings.Register()
+	portFlag := flag.String("port", "", "Port to run the server on")
+	flag.StringVar(&mainServerURL, "main-server-url", mainServerURL, "Main server to register with (env MAIN_SERVER_URL)")
+	advertiseScheme := flag.String("advertise-scheme", os.Getenv("ADVERTISE_SCHEME"),
+		"Scheme of the URL handed to clients, http or https; defaults to https when TLS is on. "+
+			"Set https behind a TLS terminating proxy (env ADVERTISE_SCHEME)")
+	flag.IntVar(&capacity, "capacity", settings.EnvInt("CAPACITY", capacity),
+		"WebSocket clients to accept before refusing connections (env CAPACITY)")
+	flag.IntVar(&maxConnectionsPerClient, "max-connections-per-client", settings.EnvInt("MAX_CONNECTIONS_PER_CLIENT", maxConnectionsPerClient),
+		"Connections one clientId may hold open in a session, older ones are closed (env MAX_CONNECTIONS_PER_CLIENT)")
+	flag.Int64Var(&maxMessageSize, "max-message-size", int64(settings.EnvInt("MAX_MESSAGE_SIZE", int(maxMessageSize))),
+		"Largest WebSocket message a client may send, in bytes (env MAX_MESSAGE_SIZE)")
+	flag.DurationVar(&stateFlushInterval, "state-flush-interval", settings.EnvDuration("STATE_FLUSH_INTERVAL", stateFlushInterval),
+		"Minimum time between stored state updates of a session, 0 stores every one (env STATE_FLUSH_INTERVAL)")
+	flag.DurationVar(&sessionTTL, "session-ttl", settings.EnvDuration("SESSION_TTL", sessionTTL),
+		"How long a session lives after its last state update (env SESSION_TTL)")
+	flag.IntVar(&registerMaxAttempts, "register-max-attempts", settings.EnvInt("REGISTER_MAX_ATTEMPTS", registerMaxAttempts),
+		"Attempts at registering with the main server before exiting (env REGISTER_MAX_ATTEMPTS)")
+	flag.DurationVar(&registerTimeout, "register-timeout", settings.EnvDuration("REGISTER_TIMEOUT", registerTimeout),
+		"How long to keep trying to register with the main server (env REGISTER_TIMEOUT)")
+	flag.StringVar(&hlsDelivery, "hls-delivery", settings.EnvOr("HLS_DELIVERY", "proxy"),
+		"How players get video, proxy through this server or presign S3 URLs (env HLS_DELIVERY)")
+	flag.DurationVar(&presignExpiry, "presign-expiry", settings.EnvDuration("PRESIGN_EXPIRY", presignExpiry),
+		"How long presigned URLs stay valid past their segment's position (env PRESIGN_EXPIRY)")
+	flag.Parse()
+	if err := cfg.Validate(true); err != nil {
+		log.Fatal(err)
+	}
+	if capacity <= 0 {
+		log.Fatalf("capacity must be positive, got %d", capacity)
 	}
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if maxConnectionsPerClient <= 0 {
+		log.Fatalf("max connections per client must be positive, got %d", maxConnectionsPerClient)
+	}
+	if maxMessageSize <= 0 {
+		log.Fatalf("max message size must be positive, got %d", maxMessageSize)
+	}
+	if stateFlushInterval < 0 {
+		log.Fatalf("state flush interval can't be negative, got %v", stateFlushInterval)
+	}
+	if sessionTTL <= 0 {
+		log.Fatalf("session TTL must be positive, got %v", sessionTTL)
+	}
+	if registerMaxAttempts <= 0 {
+		log.Fatalf("register max attempts must be positive, got %d", registerMaxAttempts)
+	}
+	if registerTimeout <= 0 {
+		log.Fatalf("register timeout must be positive, got %v", registerTimeout)
+	}
+	if hlsDelivery != "proxy" && hlsDelivery != "presign" {
+		log.Fatalf("HLS delivery must be \"proxy\" or \"presign\", got %q", hlsDelivery)
+	}
+	if presignExpiry <= 0 {
+		log.Fatalf("presign expiry must be positive, got %v", presignExpiry)
+	}
+	if *advertiseScheme != "" && *advertiseScheme != "http" && *advertiseScheme != "https" {
+		log.Fatalf("advertised scheme must be http or https, got %q", *advertiseScheme)
+	}
+
+	// The upgrade fails with 403 for origins outside the allowlist
+	allowedOrigins = cfg.AllowedOrigins
+	trustedProxies = cfg.TrustedProxies
+	upgrader.CheckOrigin = cfg.CheckOrigin
+
+	// Initialize AWS S3 client
+	s3Bucket = cfg.S3Bucket
+	awsCfg, err := cfg.LoadAWSConfig(ctx)
 	if err != nil {
 		log.Fatalf("unable to load AWS SDK config: %v", err)
 	}
-	s3Client = s3.NewFromConfig(cfg)
-}
+	s3Client = s3.NewFromConfig(awsCfg)
+	presignClient = s3.NewPresignClient(s3Client)
 
-func main() {
-	rdb = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
-	})
+	rdb = cfg.NewRedisClient()
+	sessionStore = store.NewSessionStore(rdb)
+	settings.CountRedisErrors(rdb, redisErrors)
 
 	pong, err := rdb.Ping(ctx).Result()
 	if err != nil {
 		log.Fatalf("Could not connect to Redis: %v", err)
 	}
-	log.Println(pong, "Connected to Redis")
-
-	portFlag := flag.String("port", "", "Port to run the server on")
-	flag.Parse()
+	slog.Info("Connected to Redis", "reply", pong)
 
 	if serverID == "" {
-		serverID = fmt.Sprintf("ss-%d", time.Now().Unix())
+		// The UUID suffix keeps servers started in the same second apart
+		serverID = fmt.Sprintf("ss-%d-%s", time.Now().Unix(), uuid.New().String()[:8])
 	}
 	if *portFlag != "" {
 		serverPort = *portFlag
@@ -131,69 +335,239 @@ func main() {
 		serverPort = "8081"
 	}
 
+	// Clients connect with ws:// or wss:// to match, so the scheme has to be
+	// what they'll see, which differs from ours behind a TLS proxy
+	scheme := *advertiseScheme
+	if scheme == "" {
+		scheme = "http"
+		if cfg.TLSEnabled() {
+			scheme = "https"
+		}
+	}
 	if serverURL == "" {
-		serverURL = "http://localhost:" + serverPort
+		serverURL = scheme + "://localhost:" + serverPort
+	} else if *advertiseScheme != "" {
+		_, host, found := strings.Cut(serverURL, "://")
+		if !found {
+			host = serverURL
+		}
+		serverURL = scheme + "://" + host
+	}
+
+	// Stop on SIGINT/SIGTERM, handing clients to other servers first
+	stopCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Register with main server, which may still be starting up
+	if err := registerWithRetry(stopCtx); err != nil {
+		log.Fatalf("Error registering with main server: %v", err)
 	}
 
-	// Register with main server
-	registerWithMainServer()
+	// Start heartbeat goroutine, it stops before we deregister so that a
+	// late heartbeat can't race the deregistration
+	heartbeatsDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatsDone)
+		sendHeartbeats(stopCtx)
+	}()
 
-	// Start heartbeat goroutine
-	go sendHeartbeats()
+	// Hand clients back to the main server if we get dropped from the registry
+	go subscribeToServerReassign()
 
 	// Setup routes
 	r := mux.NewRouter()
+	r.Use(settings.LogRequests)
 	r.HandleFunc("/ws", handleWebSocket)
 	r.HandleFunc("/status", handleStatus)
+	r.HandleFunc("/healthz", handleHealthz).Methods("GET")
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
 
 	// HLS routes
 	r.HandleFunc("/hls/{sessionID}/master.m3u8", serveHLSMasterPlaylist).Methods("GET", "OPTIONS")
+	r.HandleFunc("/hls/{sessionID}/poster.jpg", serveHLSPoster).Methods("GET", "OPTIONS")
+	r.HandleFunc("/hls/{sessionID}/subtitles/{lang:[A-Za-z0-9-]+}.vtt", serveHLSSubtitles).Methods("GET", "OPTIONS")
 	r.HandleFunc("/hls/{sessionID}/{quality}/playlist.m3u8", serveHLSQualityPlaylist).Methods("GET", "OPTIONS")
 	r.HandleFunc("/hls/{sessionID}/{quality}/{segmentName}", serveHLSQualitySegment).Methods("GET", "OPTIONS")
 
+	// DASH routes
+	r.HandleFunc("/dash/{sessionID}/"+DASH_MANIFEST_NAME, serveDASHManifest).Methods("GET", "OPTIONS")
+	r.HandleFunc("/dash/{sessionID}/{segmentName}", serveDASHSegment).Methods("GET", "OPTIONS")
+
 	// Wrap the router with Gorilla's CORS handler:
 	corsHandler := handlers.CORS(
-		handlers.AllowedOrigins([]string{"*"}),
+		handlers.AllowedOrigins(cfg.CORSOrigins()),
 		handlers.AllowedMethods([]string{"GET", "OPTIONS"}),
-		handlers.AllowedHeaders([]string{"Content-Type", "Range"}),
-		handlers.ExposedHeaders([]string{"Content-Length", "Content-Range", "Accept-Ranges"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Range", settings.RequestIDHeader}),
+		handlers.ExposedHeaders([]string{"Content-Length", "Content-Range", "Accept-Ranges", settings.RequestIDHeader}),
 	)(r)
 
-	log.Printf("Streaming server starting on port %s", serverPort)
-	log.Fatal(http.ListenAndServe(":"+serverPort, corsHandler))
+	srv := &http.Server{Addr: ":" + serverPort, Handler: settings.RequestID(corsHandler)}
+	go func() {
+		slog.Info("Streaming server starting", "port", serverPort)
+		if err := cfg.ListenAndServe(srv); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-stopCtx.Done()
+	<-heartbeatsDone
+	shutdown(srv, cfg.ShutdownTimeout)
+}
+
+// shutdown drains the server: new WebSocket connections are refused, the
+// main server stops handing out this server, and connected clients are told
+// to reconnect elsewhere. It waits up to timeout for them to go.
+func shutdown(srv *http.Server, timeout time.Duration) {
+	slog.Info("Shutting down, draining clients")
+	draining.Store(true)
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Store the positions of scrubs still being coalesced
+	flushAllPendingStates()
+
+	// Deregister before telling clients, so that when they validate their
+	// session again they're assigned a different server
+	deregisterFromMainServer()
+
+	payload, _ := json.Marshal(map[string]string{
+		"type":     "serverDraining",
+		"serverId": serverID,
+	})
+	disconnectAll(payload)
+
+	// Shutdown doesn't wait for hijacked connections, so wait for the
+	// WebSocket read loops to clean up their clients
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+wait:
+	for {
+		numClients_lock.Lock()
+		remaining := numClients
+		numClients_lock.Unlock()
+		if remaining == 0 {
+			break
+		}
+		select {
+		case <-shutdownCtx.Done():
+			slog.Warn("Gave up waiting for clients to disconnect", "remaining", remaining)
+			break wait
+		case <-ticker.C:
+		}
+	}
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error shutting down", "error", err)
+	}
+	rdb.Close()
+	slog.Info("Streaming server stopped")
+}
+
+// deregisterFromMainServer removes this server from the main server's registry
+func deregisterFromMainServer() {
+	jsonData, err := json.Marshal(StreamingServer{ID: serverID})
+	if err != nil {
+		slog.Error("Error marshaling server data", "error", err)
+		return
+	}
+
+	resp, err := postToMainServer("/api/streaming-servers/deregister", jsonData)
+	if err != nil {
+		slog.Error("Error deregistering from main server", "error", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		slog.Error("Failed to deregister from main server", "status", resp.Status)
+		return
+	}
+	slog.Info("Deregistered from main server")
+}
+
+// errServerIDTaken means another live streaming server holds serverID,
+// retrying won't help
+var errServerIDTaken = errors.New("server ID is already in use by another streaming server")
+
+// registerWithRetry registers with the main server, backing off exponentially
+// between failed attempts. It gives up after registerMaxAttempts attempts,
+// registerTimeout, or once stop is done.
+func registerWithRetry(stop context.Context) error {
+	stop, cancel := context.WithTimeout(stop, registerTimeout)
+	defer cancel()
+
+	backoff := REGISTER_INITIAL_BACKOFF
+	for attempt := 1; ; attempt++ {
+		err := registerWithMainServer()
+		if err == nil || err == errServerIDTaken {
+			return err
+		}
+		if attempt >= registerMaxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		slog.Warn("Registering with main server failed, retrying",
+			"attempt", attempt, "max_attempts", registerMaxAttempts, "backoff", backoff.String(), "error", err)
+		select {
+		case <-stop.Done():
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, REGISTER_MAX_BACKOFF)
+	}
 }
 
-func registerWithMainServer() {
+// registerWithMainServer makes one registration attempt
+func registerWithMainServer() error {
+	numClients_lock.Lock()
 	server := StreamingServer{
 		ID:          serverID,
 		URL:         serverURL,
 		Capacity:    capacity,
-		CurrentLoad: 0,
+		CurrentLoad: numClients,
 		Status:      "active",
 		LastPing:    time.Now().Unix(),
 	}
+	numClients_lock.Unlock()
 
 	jsonData, err := json.Marshal(server)
 	if err != nil {
-		log.Fatal("Error marshaling server data:", err)
+		return err
 	}
 
-	resp, err := http.Post(mainServerURL+"/api/streaming-servers/register", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := postToMainServer("/api/streaming-servers/register", jsonData)
 	if err != nil {
-		log.Fatal("Error registering with main server:", err)
+		return err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusConflict {
+		return errServerIDTaken
+	}
 	if resp.StatusCode != http.StatusOK {
-		log.Fatal("Failed to register with main server")
+		return fmt.Errorf("main server responded %s", resp.Status)
 	}
 
-	log.Println("Successfully registered with main server")
+	slog.Info("Registered with main server", "server_id", serverID)
+	return nil
 }
 
-func sendHeartbeats() {
+// sendHeartbeats reports this server's load to the main server until stop is
+// done. If the main server has forgotten this server, or heartbeats keep
+// failing, it registers again.
+func sendHeartbeats(stop context.Context) {
 	ticker := time.NewTicker(HEARTBEAT_INTERVAL * time.Second)
-	for range ticker.C {
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-stop.Done():
+			return
+		case <-ticker.C:
+		}
+
 		numClients_lock.Lock()
 		server := StreamingServer{
 			ID:          serverID,
@@ -207,17 +581,55 @@ func sendHeartbeats() {
 
 		jsonData, err := json.Marshal(server)
 		if err != nil {
-			log.Println("Error marshaling heartbeat data:", err)
+			slog.Error("Error marshaling heartbeat data", "error", err)
 			continue
 		}
 
-		resp, err := http.Post(mainServerURL+"/api/streaming-servers/heartbeat", "application/json", bytes.NewBuffer(jsonData))
-		if err != nil {
-			log.Println("Error sending heartbeat:", err)
+		resp, err := postToMainServer("/api/streaming-servers/heartbeat", jsonData)
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		switch {
+		case err == nil && resp.StatusCode == http.StatusOK:
+			failures = 0
+			continue
+		case err == nil && resp.StatusCode == http.StatusNotFound:
+			// Our entry expired, e.g. the main server was down for a while
+			slog.Warn("Main server no longer knows this server, registering again")
+		case err == nil && resp.StatusCode == http.StatusForbidden:
+			slog.Error("Main server rejected heartbeat, server ID is registered by another process", "server_id", serverID)
 			continue
+		default:
+			if err != nil {
+				slog.Warn("Error sending heartbeat", "error", err)
+			} else {
+				slog.Warn("Heartbeat rejected by main server", "status", resp.Status)
+			}
+			failures++
+			if failures < MAX_HEARTBEAT_FAILURES {
+				continue
+			}
+			slog.Warn("Heartbeats keep failing, registering again", "failures", failures)
 		}
-		resp.Body.Close()
+
+		if err := registerWithRetry(stop); err != nil {
+			slog.Error("Registering again failed", "error", err)
+			continue
+		}
+		failures = 0
+	}
+}
+
+// postToMainServer posts JSON to the main server, authenticated with serverToken
+func postToMainServer(path string, jsonData []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, mainServerURL+path, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Server-Token", serverToken)
+	return http.DefaultClient.Do(req)
 }
 
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
@@ -226,80 +638,150 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing session ID", http.StatusBadRequest)
 		return
 	}
+	if draining.Load() {
+		wsRejected.WithLabelValues("draining").Inc()
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if !validSessionKey(sessionID) {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+	clientID := r.URL.Query().Get("clientId")
+	if clientID != "" && !validClientID(clientID) {
+		http.Error(w, "Invalid client ID", http.StatusBadRequest)
+		return
+	}
+
+	logger := settings.Logger(r.Context()).With("session_id", sessionID)
+
+	// Only upgrade for live sessions, so unknown IDs don't show up in clients
+	exists, err := sessionStore.Exists(ctx, sessionID)
+	if err != nil {
+		logger.Error("Redis error checking session", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	// Private sessions need the join token handed out by the main server's
+	// validate endpoint once the client has given the password
+	if ok, err := hasJoinAccess(sessionID, r.URL.Query().Get("joinToken")); err != nil {
+		logger.Error("Redis error checking join token", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "Password required", http.StatusUnauthorized)
+		return
+	}
+
+	// Kicked clients stay out for the rest of the session
+	ip := clientIP(r)
+	banned, err := rdb.SMIsMember(ctx, store.Key(sessionID, store.Banned), banEntries(clientID, ip)...).Result()
+	if err != nil {
+		logger.Error("Redis error checking bans", "error", err)
+	}
+	for _, b := range banned {
+		if b {
+			http.Error(w, "Removed from session", http.StatusForbidden)
+			return
+		}
+	}
+
+	// Host control needs the current host token, which changes when the host
+	// hands the session over
+	isHost := false
+	if r.URL.Query().Get("isHost") == "true" {
+		isHost, err = isSessionHost(sessionID, r.URL.Query().Get("hostToken"))
+		if err != nil {
+			logger.Error("Redis error checking host token", "error", err)
+		} else if !isHost {
+			logger.Warn("Connecting as participant, host token missing or outdated")
+		}
+	}
+
+	// Hold a slot from before the upgrade so concurrent connections can't
+	// take the server past its capacity; cleanupClient gives it back
+	if !reserveClientSlot() {
+		wsRejected.WithLabelValues("capacity").Inc()
+		logger.Warn("Refusing connection, server at capacity", "capacity", capacity)
+		w.Header().Set("Retry-After", CAPACITY_RETRY_AFTER)
+		http.Error(w, "Server at capacity", http.StatusServiceUnavailable)
+		return
+	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("Error upgrading connection:", err)
+		releaseClientSlot()
+		logger.Error("Error upgrading connection", "error", err)
 		return
 	}
 
-	isHost := r.URL.Query().Get("isHost") == "true"
+	id := uuid.New().String()
 	client := &ClientConnection{
 		conn:      conn,
+		id:        id,
+		clientID:  clientID,
+		name:      displayName(r.URL.Query().Get("name")),
 		sessionID: sessionID,
-		isHost:    isHost,
+		ip:        ip,
+		log:       logger.With("participant_id", id),
 	}
+	client.isHost.Store(isHost)
+	client.log.Info("Client connected", "is_host", isHost, "client_ip", ip)
+
+	// Oversized messages fail the read, which disconnects the client before
+	// anything is unmarshaled
+	conn.SetReadLimit(maxMessageSize)
+
+	// Drop clients that stop answering pings
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
 
 	client.send = make(chan []byte, 256)
+	client.final = make(chan []byte, 1)
+	client.done = make(chan struct{})
 	go client.writePump()
 
-	// Initialize mutex for this session if it doesn't exist
-	if _, exists := client_lock[sessionID]; !exists {
-		client_lock[sessionID] = &sync.Mutex{}
+	// A browser reconnecting faster than its old sockets time out, or opening
+	// many tabs, keeps only its newest connections
+	for _, old := range clients.addLimited(client, maxConnectionsPerClient) {
+		old.log.Info("Closing connection replaced by a newer one", "replaced_by", client.id)
+		payload, _ := json.Marshal(map[string]string{
+			"type":       "connectionReplaced",
+			"replacedBy": client.id,
+		})
+		old.disconnect(payload)
 	}
-
-	client_lock[sessionID].Lock()
-	clients[sessionID] = append(clients[sessionID], client)
-	client_lock[sessionID].Unlock()
-
-	numClients_lock.Lock()
-	numClients += 1
-	numClients_lock.Unlock()
+	wsConnections.Inc()
+	updateParticipantCount(sessionID, 1)
 	defer cleanupClient(client)
 
 	subscribeToSessionUpdates(sessionID)
 
-	// Send the initial state to the client
-	if !client.isHost {
-		if client.conn != nil {
-			ctx := context.Background()
-			val, err := rdb.Get(ctx, "session:"+client.sessionID+":state").Result()
-
-			if err == redis.Nil {
-				log.Printf("Invalid Session key %s \n", client.sessionID)
-			} else if err != nil {
-				log.Println("Error Synchronizing")
-			}
-
-			var state json.RawMessage
-			err = json.Unmarshal([]byte(val), &state)
-			if err != nil {
-				log.Println("Error unmarshaling state:", err)
-				return
-			}
+	// Tell the client who it is and who's here, then announce it to the others
+	sendParticipants(client)
+	sendChatHistory(client)
+	publishSessionMessage(sessionID, map[string]interface{}{
+		"type":        "participantJoined",
+		"participant": client.participant(),
+	})
 
-			payload, err := json.Marshal(map[string]interface{}{
-				"type":       "stateUpdate",
-				"state":      state,
-				"servertime": time.Now().UnixMilli(),
-			})
-			if err != nil {
-				log.Println("Error marshaling state:", err)
-				return
-			}
+	// Send the current state to every client, including a host coming back
+	// after a refresh. Until it catches up, a host's stale stateUpdates lose
+	// the timestamp comparison against the stored state.
+	sendInitialState(client)
 
-			select {
-			case client.send <- payload:
-			default:
-				log.Printf("Dropping message to client in session %s (send buffer full)", sessionID)
-			}
-		}
-	}
 	// Handle messages
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
-			log.Println("Error reading message:", err)
+			client.log.Info("Client disconnected", "reason", err.Error())
 			break
 		}
 
@@ -307,176 +789,612 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// sendInitialState sends a newly connected client the session's stored state
+func sendInitialState(client *ClientConnection) {
+	state, err := sessionStore.GetState(ctx, client.sessionID)
+	if err == redis.Nil {
+		// No state yet, the first controller to play sets it
+		return
+	} else if err != nil {
+		client.log.Error("Error getting session state", "error", err)
+		return
+	}
+
+	now := time.Now()
+	payload, err := json.Marshal(map[string]interface{}{
+		"type":       "stateUpdate",
+		"state":      liveState(state, now),
+		"servertime": now.UnixMilli(),
+	})
+	if err != nil {
+		client.log.Error("Error marshaling state", "error", err)
+		return
+	}
+
+	select {
+	case client.send <- payload:
+	default:
+		client.log.Warn("Dropping initial state, send buffer full")
+	}
+}
+
+// liveState advances a playing state from when it was stored to now, so a
+// client joining mid-playback starts at the room's playhead rather than where
+// the host was at its last update. Paused states are returned unchanged.
+func liveState(state RedisState, now time.Time) RedisState {
+	if state.Paused {
+		return state
+	}
+	elapsed := now.UnixMilli() - state.Timestamp
+	if elapsed <= 0 {
+		// Host clock ahead of ours, nothing to make up
+		return state
+	}
+
+	rate := state.PlaybackRate
+	if rate <= 0 {
+		rate = 1
+	}
+	state.CurrentTime += float64(elapsed) / 1000 * rate
+	state.Timestamp = now.UnixMilli()
+	return state
+}
+
+// isSessionHost reports whether hostToken is the session's current host token
+func isSessionHost(sessionID, hostToken string) (bool, error) {
+	isHost, err := sessionStore.ValidateHost(ctx, sessionID, hostToken)
+	if err == store.ErrSessionNotFound {
+		return false, nil
+	}
+	return isHost, err
+}
+
+// hasJoinAccess reports whether a client may join the session, which needs an
+// unexpired join token when the session has a password
+func hasJoinAccess(sessionID, joinToken string) (bool, error) {
+	protected, err := rdb.Exists(ctx, store.Key(sessionID, store.Password)).Result()
+	if err != nil || protected == 0 {
+		return err == nil, err
+	}
+	if joinToken == "" {
+		return false, nil
+	}
+	valid, err := rdb.Exists(ctx, store.JoinKey(sessionID, joinToken)).Result()
+	return valid == 1, err
+}
+
 func (c *ClientConnection) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
 	for {
-		msg, ok := <-c.send
-		if !ok {
-			// Channel closed, close the WebSocket
+		select {
+		case <-ticker.C:
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WRITE_WAIT))
+			if err != nil {
+				c.log.Warn("Error sending ping", "error", err)
+				return
+			}
+
+		case <-c.done:
+			// Client cleaned up, close the WebSocket
 			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 			return
-		}
 
-		err := c.conn.WriteMessage(websocket.TextMessage, msg)
-		if err != nil {
-			log.Println("writePump error:", err)
+		case msg := <-c.send:
+			err := c.conn.WriteMessage(websocket.TextMessage, msg)
+			if err != nil {
+				c.log.Warn("Error writing message", "error", err)
+				return
+			}
+
+		case msg := <-c.final:
+			// Deliver the last message, then close so the read loop cleans up
+			c.conn.WriteMessage(websocket.TextMessage, msg)
+			c.conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			c.conn.Close()
 			return
 		}
 	}
 }
 
+// disconnect sends payload as the client's final message and closes the socket
+func (c *ClientConnection) disconnect(payload []byte) {
+	select {
+	case c.final <- payload:
+	default:
+		// Already disconnecting
+	}
+}
+
 func handleClientMessage(client *ClientConnection, message []byte) {
+	serverRecvTime := time.Now().UnixMilli()
+
 	var msg struct {
-		Type  string          `json:"type"`
-		State json.RawMessage `json:"state"`
+		Type       string          `json:"type"`
+		State      json.RawMessage `json:"state"`
+		ClientTime int64           `json:"clientTime"`
+		TargetID   string          `json:"targetId"`
+		Text       string          `json:"text"`
+
+		// bufferingReport
+		Stalled     bool    `json:"stalled"`
+		BufferLevel float64 `json:"bufferLevel"`
+
+		Reaction string `json:"reaction"`
 	}
 
 	if err := json.Unmarshal(message, &msg); err != nil {
-		log.Println("Error unmarshaling message:", err)
+		client.log.Error("Error unmarshaling message", "error", err)
 		return
 	}
 
 	switch msg.Type {
 	case "stateUpdate":
-		if client.isHost {
-			// log.Println(string(msg.State))
-			var ctx = context.Background()
-			val, err := rdb.Get(ctx, "session:"+client.sessionID+":state").Result()
-
-			if err == redis.Nil {
-				log.Printf("Invalid Session key %s \n", client.sessionID)
-			} else if err != nil {
-				log.Println("Error Synchronizing")
+		if client.canControl() {
+			var state RedisState
+			if err := json.Unmarshal(msg.State, &state); err != nil {
+				client.log.Error("Error unmarshaling state from message", "error", err)
+				return
 			}
+			queueStateUpdate(client.sessionID, state)
+		}
 
-			// Define a struct to hold the state with a timestamp
-			stateFromRedis := RedisState{}
-			stateFromMsg := RedisState{}
-
-			// Unmarshal the state from Redis
-			if err := json.Unmarshal([]byte(val), &stateFromRedis); err != nil {
-				log.Println("Error unmarshaling state from Redis:", err)
+	case "seek":
+		// A deliberate jump, viewers move straight to it
+		if client.canControl() {
+			var state RedisState
+			if err := json.Unmarshal(msg.State, &state); err != nil {
+				client.log.Error("Error unmarshaling seek state from message", "error", err)
 				return
 			}
-
-			// Unmarshal the state from the message
-			if err := json.Unmarshal(msg.State, &stateFromMsg); err != nil {
-				log.Println("Error unmarshaling state from message:", err)
+			if state.CurrentTime < 0 || math.IsNaN(state.CurrentTime) || math.IsInf(state.CurrentTime, 0) {
+				client.log.Warn("Ignoring invalid seek", "current_time", state.CurrentTime)
 				return
 			}
+			queueSeek(client.sessionID, state)
+		}
 
-			// Compare the timestamps
-			if stateFromMsg.Timestamp > stateFromRedis.Timestamp {
-				stateJson, _ := json.Marshal(msg.State)
-				err := rdb.SetEX(ctx, "session:"+client.sessionID+":state", stateJson, REDIS_MSG_EXPIRY).Err()
-				if err != nil {
-					log.Println("Error updating state in Redis:", err)
-				}
+	case "promoteCoHost", "demoteCoHost":
+		if !client.isHost.Load() {
+			client.log.Warn("Ignoring message from non-host", "type", msg.Type)
+			return
+		}
 
-				// Publish the state update to all clients in this session
-				publishStateUpdate(client.sessionID, msg.State)
-			}
+		target := findClient(client.sessionID, msg.TargetID)
+		if target == nil || target == client {
+			client.log.Warn("Co-host target not found", "target_id", msg.TargetID)
+			return
 		}
 
-	case "videoMetadata":
-		videoMetadata := VideoManifest{
-			ChunkDuration: 5,
-			ChunkCount:    10,
-			VideoDuration: 117,
-			VideoFileType: "mp4",
+		isCoHost := msg.Type == "promoteCoHost"
+		target.isCoHost.Store(isCoHost)
+		client.log.Info("Changed co-host", "target_id", target.id, "co_host", isCoHost)
+
+		publishSessionMessage(client.sessionID, map[string]interface{}{
+			"type":          "coHostChanged",
+			"participantId": target.id,
+			"isCoHost":      isCoHost,
+		})
+
+	case "kick":
+		target := findClient(client.sessionID, msg.TargetID)
+		if target == nil || target == client {
+			client.log.Warn("Kick target not found", "target_id", msg.TargetID)
+			return
+		}
+		// The host can kick anyone else, co-hosts only regular participants
+		allowed := client.isHost.Load() || (client.isCoHost.Load() && !target.isCoHost.Load())
+		if target.isHost.Load() || !allowed {
+			client.log.Warn("Ignoring kick", "target_id", target.id)
+			return
+		}
+
+		// Ban the participant's browser and its address, so coming back
+		// with a new clientId doesn't get it in again
+		bannedKey := store.Key(client.sessionID, store.Banned)
+		_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SAdd(ctx, bannedKey, banEntries(target.clientID, target.ip)...)
+			pipe.Expire(ctx, bannedKey, sessionTTL)
+			return nil
+		})
+		if err != nil {
+			client.log.Error("Error banning participant", "target_id", target.id, "error", err)
+		}
+
+		client.log.Info("Participant kicked", "target_id", target.id)
+		payload, _ := json.Marshal(map[string]string{
+			"type":     "kicked",
+			"kickedBy": client.id,
+		})
+		target.disconnect(payload)
+
+	case "getParticipants":
+		sendParticipants(client)
+
+	case "chat":
+		text := strings.TrimSpace(msg.Text)
+		if text == "" || utf8.RuneCountInString(text) > MAX_CHAT_LENGTH {
+			client.log.Warn("Dropping oversized chat message", "bytes", len(msg.Text))
+			return
 		}
 
+		chat := ChatMessage{
+			Type:          "chat",
+			ParticipantID: client.id,
+			Name:          client.name,
+			Text:          text,
+			Timestamp:     time.Now().UnixMilli(),
+		}
+		saveChatMessage(client.sessionID, chat)
+		publishSessionMessage(client.sessionID, chat)
+
+	case "reaction":
+		handleReaction(client, msg.Reaction)
+
+	case "videoMetadata":
+		videoMetadata := getVideoManifest(client.sessionID)
+
 		payload, err := json.Marshal(map[string]interface{}{
 			"type":  "videoMetadata",
 			"state": videoMetadata,
 		})
 
 		if err != nil {
-			log.Println("Error marshaling video metadata:", err)
+			client.log.Error("Error marshaling video metadata", "error", err)
 			return
 		}
 		client.send <- payload
 
 	case "heartbeat":
-		// Send heartbeat acknowledgment
-		client.conn.WriteJSON(map[string]string{"type": "heartbeatAck"})
-	}
-}
+		// Echo the client's timestamp so it can estimate latency and clock
+		// offset NTP-style: offset = ((recv - client) + (send - clientRecv)) / 2
+		payload, err := json.Marshal(map[string]interface{}{
+			"type":           "heartbeatAck",
+			"clientTime":     msg.ClientTime,
+			"serverRecvTime": serverRecvTime,
+			"serverSendTime": time.Now().UnixMilli(),
+		})
+		if err != nil {
+			client.log.Error("Error marshaling heartbeat ack", "error", err)
+			return
+		}
+
+		select {
+		case client.send <- payload:
+		default:
+			client.log.Warn("Dropping heartbeat ack, send buffer full")
+		}
+
+	case "bufferingReport":
+		handleBufferingReport(client, msg.Stalled, msg.BufferLevel)
+	}
+}
+
+// canControl reports whether the client's state updates drive playback
+func (c *ClientConnection) canControl() bool {
+	return c.isHost.Load() || c.isCoHost.Load()
+}
+
+// findClient returns the local client with the given participant ID
+func findClient(sessionID, id string) *ClientConnection {
+	return clients.find(sessionID, id)
+}
+
+// getVideoManifest reads the manifest written by the upload server, falling
+// back to an empty manifest when the video hasn't been uploaded yet
+func getVideoManifest(sessionID string) VideoManifest {
+	manifest := VideoManifest{
+		ChunkDuration: CHUNK_DURATION,
+		VideoFileType: "mp4",
+		Qualities:     []string{},
+	}
+
+	val, err := rdb.Get(ctx, store.Key(sessionID, store.Manifest)).Result()
+	if err == redis.Nil {
+		slog.Info("No manifest", "session_id", sessionID)
+		return manifest
+	} else if err != nil {
+		slog.Error("Error getting manifest", "session_id", sessionID, "error", err)
+		return manifest
+	}
+
+	if err := json.Unmarshal([]byte(val), &manifest); err != nil {
+		slog.Error("Error unmarshaling manifest", "session_id", sessionID, "error", err)
+		return manifest
+	}
+
+	if manifest.ChunkDuration <= 0 {
+		manifest.ChunkDuration = CHUNK_DURATION
+	}
+	manifest.ChunkCount = int(math.Ceil(manifest.VideoDuration / float64(manifest.ChunkDuration)))
+	return manifest
+}
+
+// reserveClientSlot counts a new client unless the server is at capacity
+func reserveClientSlot() bool {
+	numClients_lock.Lock()
+	defer numClients_lock.Unlock()
+
+	if numClients >= capacity {
+		return false
+	}
+	numClients += 1
+	return true
+}
+
+func releaseClientSlot() {
+	numClients_lock.Lock()
+	numClients -= 1
+	numClients_lock.Unlock()
+}
 
 func cleanupClient(client *ClientConnection) {
 	if client == nil || client.sessionID == "" {
 		return
 	}
-	if client.send != nil {
-		close(client.send)
+	// send stays open, broadcasters holding a snapshot of the session's
+	// clients may still queue to it
+	if client.done != nil {
+		close(client.done)
 	}
 
-	if _, exists := client_lock[client.sessionID]; !exists {
-		client_lock[client.sessionID] = &sync.Mutex{}
+	if !clients.remove(client) {
+		return
+	}
+	// Safely close the connection
+	if client.conn != nil {
+		client.conn.Close()
 	}
+	unsubscribeFromSessionUpdates(client.sessionID)
 
-	client_lock[client.sessionID].Lock()
-	sessionClients, exists := clients[client.sessionID]
-	if !exists || len(sessionClients) == 0 {
-		client_lock[client.sessionID].Unlock()
+	releaseClientSlot()
+	updateParticipantCount(client.sessionID, -1)
+	clientLeftBuffering(client)
+
+	publishSessionMessage(client.sessionID, map[string]interface{}{
+		"type":        "participantLeft",
+		"participant": client.participant(),
+	})
+}
+
+// saveChatMessage appends to the session's chat history, keeping the last
+// CHAT_HISTORY_SIZE messages for as long as the session lives
+func saveChatMessage(sessionID string, chat ChatMessage) {
+	payload, err := json.Marshal(chat)
+	if err != nil {
+		slog.Error("Error marshaling chat message", "session_id", sessionID, "error", err)
 		return
 	}
 
-	for i, c := range sessionClients {
-		if c == client {
-			// Safely close the connection
-			if client.conn != nil {
-				client.conn.Close()
-			}
+	ttl, err := sessionStore.TTL(ctx, sessionID)
+	if err != nil || ttl <= 0 {
+		ttl = REDIS_MSG_EXPIRY
+	}
 
-			// Remove the client from the slice
-			clients[client.sessionID] = append(sessionClients[:i], sessionClients[i+1:]...)
-			break
+	chatKey := store.Key(sessionID, store.Chat)
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, chatKey, payload)
+		pipe.LTrim(ctx, chatKey, -CHAT_HISTORY_SIZE, -1)
+		pipe.Expire(ctx, chatKey, ttl)
+		return nil
+	})
+	if err != nil {
+		slog.Error("Error saving chat message", "session_id", sessionID, "error", err)
+	}
+}
+
+// sendChatHistory sends a newly connected client the recent chat messages
+func sendChatHistory(client *ClientConnection) {
+	history, err := rdb.LRange(ctx, store.Key(client.sessionID, store.Chat), 0, -1).Result()
+	if err != nil {
+		client.log.Error("Error getting chat history", "error", err)
+		return
+	}
+
+	messages := make([]json.RawMessage, 0, len(history))
+	for _, m := range history {
+		messages = append(messages, json.RawMessage(m))
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"type":     "chatHistory",
+		"messages": messages,
+	})
+	if err != nil {
+		client.log.Error("Error marshaling chat history", "error", err)
+		return
+	}
+
+	select {
+	case client.send <- payload:
+	default:
+		client.log.Warn("Dropping chat history, send buffer full")
+	}
+}
+
+// updateParticipantCount adjusts session:{id}:participants, which lets the
+// main server report how many people are in a session
+func updateParticipantCount(sessionID string, delta int64) {
+	key := store.Key(sessionID, store.Participants)
+	ttl, err := sessionStore.TTL(ctx, sessionID)
+	if err != nil || ttl <= 0 {
+		ttl = sessionTTL
+	}
+
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.IncrBy(ctx, key, delta)
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		slog.Error("Error updating participant count", "session_id", sessionID, "error", err)
+	}
+}
+
+// displayName cleans up a client supplied display name
+func displayName(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return DEFAULT_NAME
+	}
+	if runes := []rune(name); len(runes) > MAX_NAME_LENGTH {
+		name = string(runes[:MAX_NAME_LENGTH])
+	}
+	return name
+}
+
+func (c *ClientConnection) participant() Participant {
+	return Participant{
+		ID:       c.id,
+		Name:     c.name,
+		IsHost:   c.isHost.Load(),
+		IsCoHost: c.isCoHost.Load(),
+	}
+}
+
+// sessionParticipants lists the local clients of a session
+func sessionParticipants(sessionID string) []Participant {
+	participants := []Participant{}
+	for _, c := range clients.clients(sessionID) {
+		// Replaced connections are on their way out
+		if c.replaced.Load() {
+			continue
 		}
+		participants = append(participants, c.participant())
 	}
-	client_lock[client.sessionID].Unlock()
+	return participants
+}
 
-	numClients_lock.Lock()
-	numClients -= 1
-	numClients_lock.Unlock()
+// sendParticipants replies to a client with its own ID and the participant list
+func sendParticipants(client *ClientConnection) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"type":          "participants",
+		"participantId": client.id,
+		"participants":  sessionParticipants(client.sessionID),
+	})
+	if err != nil {
+		client.log.Error("Error marshaling participants", "error", err)
+		return
+	}
+
+	select {
+	case client.send <- payload:
+	default:
+		client.log.Warn("Dropping participants, send buffer full")
+	}
 }
 
+// handleStatus reports this server's load, per session client counts and
+// whether it can reach Redis. The main server aggregates it for the fleet view.
 func handleStatus(w http.ResponseWriter, r *http.Request) {
+	numClients_lock.Lock()
+	currentLoad := numClients
+	numClients_lock.Unlock()
+
+	state := "active"
+	if draining.Load() {
+		state = "draining"
+	}
+
+	checkCtx, cancel := context.WithTimeout(r.Context(), HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+	redisStatus := "ok"
+	if err := rdb.Ping(checkCtx).Err(); err != nil {
+		redisStatus = err.Error()
+	}
+
 	status := map[string]interface{}{
-		"id":          serverID,
-		"url":         serverURL,
-		"capacity":    capacity,
-		"currentLoad": numClients,
-		"status":      "active",
-		"lastPing":    time.Now().Unix(),
+		"id":            serverID,
+		"url":           serverURL,
+		"capacity":      capacity,
+		"currentLoad":   currentLoad,
+		"status":        state,
+		"lastPing":      time.Now().Unix(),
+		"startedAt":     startedAt.Format(time.RFC3339),
+		"uptimeSeconds": int64(time.Since(startedAt).Seconds()),
+		"redis":         redisStatus,
+		"sessions":      clients.counts(),
+		"buffering":     allBufferingSummaries(),
 	}
 
 	respondJSON(w, http.StatusOK, status)
 }
 
+// handleHealthz checks Redis and S3 access, responding 503 if either fails
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	checkCtx, cancel := context.WithTimeout(r.Context(), HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+
+	healthy := true
+	dependencies := map[string]string{"redis": "ok", "s3": "ok"}
+	if err := rdb.Ping(checkCtx).Err(); err != nil {
+		settings.Logger(r.Context()).Warn("Health check: Redis unreachable", "error", err)
+		healthy = false
+		dependencies["redis"] = err.Error()
+	}
+	if _, err := s3Client.HeadBucket(checkCtx, &s3.HeadBucketInput{Bucket: aws.String(s3Bucket)}); err != nil {
+		settings.Logger(r.Context()).Warn("Health check: S3 bucket unreachable", "bucket", s3Bucket, "error", err)
+		healthy = false
+		dependencies["s3"] = err.Error()
+	}
+
+	if !healthy {
+		respondJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"status":       "unhealthy",
+			"dependencies": dependencies,
+		})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"status":       "healthy",
+		"dependencies": dependencies,
+	})
+}
+
 // ////////////////////////////////////// PUBSUB FUNCTIONS //////////////////////////////////////////////////////////////
 func publishStateUpdate(sessionID string, state json.RawMessage) {
 	ctx := context.Background()
 	payload, err := json.Marshal(state)
 	if err != nil {
-		log.Println("Error marshaling state for publish:", err)
+		slog.Error("Error marshaling state for publish", "session_id", sessionID, "error", err)
 		return
 	}
 
-	err = rdb.Publish(ctx, "session-updates:"+sessionID, string(payload)).Err()
+	err = sessionStore.Publish(ctx, sessionID, payload)
 	if err != nil {
-		log.Println("Error publishing state update:", err)
+		slog.Error("Error publishing state update", "session_id", sessionID, "error", err)
 	}
 }
 
+// subscribeToSessionUpdates registers a local client with the session's Redis
+// subscription, starting the subscription for the first client only
 func subscribeToSessionUpdates(sessionID string) {
-	ctx := context.Background()
-	pubsub = rdb.Subscribe(ctx, "session-updates:"+sessionID)
+	subscriptions_lock.Lock()
+	defer subscriptions_lock.Unlock()
+
+	if sub, exists := subscriptions[sessionID]; exists {
+		sub.refs++
+		return
+	}
+
+	subCtx, cancel := context.WithCancel(context.Background())
+	sub := &sessionSubscription{
+		pubsub: sessionStore.Subscribe(subCtx, sessionID),
+		cancel: cancel,
+		refs:   1,
+	}
+	subscriptions[sessionID] = sub
 
 	go func() {
 		for {
-			msg, err := pubsub.ReceiveMessage(ctx)
+			msg, err := sub.pubsub.ReceiveMessage(subCtx)
 			if err != nil {
-				log.Println("Error receiving message:", err)
+				if subCtx.Err() != nil || err == redis.ErrClosed {
+					return
+				}
+				slog.Error("Error receiving message", "session_id", sessionID, "error", err)
 				continue
 			}
 
@@ -486,69 +1404,216 @@ func subscribeToSessionUpdates(sessionID string) {
 	}()
 }
 
+// unsubscribeFromSessionUpdates drops a local client's reference and closes
+// the subscription once no clients of the session remain
+func unsubscribeFromSessionUpdates(sessionID string) {
+	subscriptions_lock.Lock()
+	sub, exists := subscriptions[sessionID]
+	if !exists {
+		subscriptions_lock.Unlock()
+		return
+	}
+	sub.refs--
+	if sub.refs > 0 {
+		subscriptions_lock.Unlock()
+		return
+	}
+	delete(subscriptions, sessionID)
+	pending := takeCoalescer(sessionID)
+	subscriptions_lock.Unlock()
+
+	// Talk to Redis without the lock, so clients of other sessions don't
+	// wait on this one. A client rejoining meanwhile starts a new
+	// subscription and coalescer.
+	if pending != nil {
+		pending.flushPending(sessionID)
+	}
+	sub.cancel()
+	if err := sub.pubsub.Close(); err != nil {
+		slog.Error("Error closing subscription", "session_id", sessionID, "error", err)
+	}
+}
+
+// publishSessionMessage publishes a typed message that every streaming server
+// forwards verbatim to the session's clients
+func publishSessionMessage(sessionID string, msg interface{}) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("Error marshaling session message", "session_id", sessionID, "error", err)
+		return
+	}
+
+	err = sessionStore.Publish(ctx, sessionID, payload)
+	if err != nil {
+		slog.Error("Error publishing session message", "session_id", sessionID, "error", err)
+	}
+}
+
 // Handle session updates received from Redis pub/sub
 func handleSessionUpdate(channel, payload string) {
 	// Extract sessionID from channel
-	sessionID := channel[len("session-updates:"):]
-	log.Printf("Received update for session %s: %s", sessionID, payload)
+	sessionID, ok := store.SessionFromChannel(channel)
+	if !ok {
+		return
+	}
+
+	// Control messages carry a type, plain state updates don't
+	var control struct {
+		Type          string `json:"type"`
+		ParticipantID string `json:"participantId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &control); err == nil && control.Type != "" {
+		slog.Debug("Received session update", "session_id", sessionID, "type", control.Type)
+		switch control.Type {
+		case "sessionEnded":
+			endSessionClients(sessionID, []byte(payload))
+		case "hostChanged":
+			changeHost(sessionID, control.ParticipantID)
+			broadcastToSession(sessionID, []byte(payload))
+		default:
+			broadcastToSession(sessionID, []byte(payload))
+		}
+		return
+	}
 
 	var state json.RawMessage
 	err := json.Unmarshal([]byte(payload), &state)
 	if err != nil {
-		log.Println("Error unmarshaling state:", err)
+		slog.Error("Error unmarshaling state", "session_id", sessionID, "error", err)
 		return
 	}
+	slog.Debug("Received session update", "session_id", sessionID, "type", "state")
 	broadcastState(sessionID, state)
 }
 
 func broadcastState(sessionID string, state json.RawMessage) {
-	if _, exists := client_lock[sessionID]; !exists {
-		client_lock[sessionID] = &sync.Mutex{}
-	}
-
-	client_lock[sessionID].Lock()
-	// Check if the session exists in the clients map
-	sessionClients, exists := clients[sessionID]
-	if !exists || len(sessionClients) == 0 {
-		client_lock[sessionID].Unlock()
+	payload, err := json.Marshal(map[string]interface{}{
+		"type":       "stateUpdate",
+		"state":      state,
+		"servertime": time.Now().UnixMilli(),
+	})
+	if err != nil {
+		slog.Error("Error marshaling broadcast state", "session_id", sessionID, "error", err)
 		return
 	}
 
-	clientsToSend := make([]*ClientConnection, len(sessionClients))
-	copy(clientsToSend, sessionClients)
-	client_lock[sessionID].Unlock()
+	broadcastToSession(sessionID, payload)
+}
 
-	for _, client := range clientsToSend {
+// broadcastToSession queues payload for every local client of a session
+func broadcastToSession(sessionID string, payload []byte) {
+	for _, client := range clients.clients(sessionID) {
 		if client == nil || client.conn == nil {
 			continue
 		}
+		select {
+		case client.send <- payload:
+		default:
+			client.log.Warn("Dropping message, send buffer full")
+		}
+	}
+}
 
-		payload, err := json.Marshal(map[string]interface{}{
-			"type":       "stateUpdate",
-			"state":      state,
-			"servertime": time.Now().UnixMilli(),
-		})
-		if err != nil {
-			log.Printf("Error marshaling broadcast state: %v", err)
-			return
+// changeHost moves host control of a session to the participant with the given
+// ID, or takes it from everyone when that participant isn't connected here
+func changeHost(sessionID, participantID string) {
+	for _, c := range clients.clients(sessionID) {
+		isHost := c.id == participantID
+		c.isHost.Store(isHost)
+		if isHost {
+			c.isCoHost.Store(false)
+			c.log.Info("Handed host control")
 		}
+	}
+}
 
-		for _, client := range clientsToSend {
-			if client == nil || client.conn == nil {
-				continue
-			}
-			select {
-			case client.send <- payload:
-			default:
-				log.Printf("Dropping message to client in session %s (send buffer full)", sessionID)
-			}
+// endSessionClients sends payload to every local client of a session and
+// disconnects them
+func endSessionClients(sessionID string, payload []byte) {
+	sessionClients := clients.clients(sessionID)
+	for _, client := range sessionClients {
+		if client == nil || client.conn == nil {
+			continue
+		}
+		client.disconnect(payload)
+	}
+	slog.Info("Disconnected session clients", "session_id", sessionID, "clients", len(sessionClients))
+}
+
+// subscribeToServerReassign listens for the main server declaring a streaming
+// server dead. If that server is this process (e.g. heartbeats were lost but
+// the process survived), every client is told to re-validate its session via
+// /api/sessions/{key}/validate and reconnect to the streaming_url it returns.
+func subscribeToServerReassign() {
+	sub := rdb.Subscribe(ctx, REASSIGN_CHANNEL)
+	defer sub.Close()
+
+	for msg := range sub.Channel() {
+		var reassign struct {
+			Type     string `json:"type"`
+			ServerID string `json:"serverId"`
+		}
+		if err := json.Unmarshal([]byte(msg.Payload), &reassign); err != nil {
+			slog.Error("Error unmarshaling reassign message", "error", err)
+			continue
+		}
+		if reassign.ServerID != serverID {
+			continue
 		}
 
+		slog.Warn("Main server dropped this server, reassigning all clients", "server_id", serverID)
+		disconnectAll([]byte(msg.Payload))
+	}
+}
+
+// disconnectAll sends payload to every local client and disconnects them
+func disconnectAll(payload []byte) {
+	for _, sessionID := range clients.sessionIDs() {
+		endSessionClients(sessionID, payload)
 	}
 }
 
 /////////////////////////////////////// HELPER FUNCTIONS //////////////////////////////////////////////////////////////
 
+// clientIP returns the originating client address, taken from
+// X-Forwarded-For only when the request came through a trusted proxy
+func clientIP(r *http.Request) string {
+	return settings.ClientIP(r, trustedProxies)
+}
+
+// banEntries are what a kick adds to the session's banned set and a
+// connection is checked against: its address, and its clientId if it sent one
+func banEntries(clientID, ip string) []interface{} {
+	entries := []interface{}{"ip:" + ip}
+	if clientID != "" {
+		entries = append(entries, "client:"+clientID)
+	}
+	return entries
+}
+
+// validClientID reports whether id is a usable clientId: letters, digits,
+// '-' and '_', at most MAX_CLIENT_ID_LENGTH long
+func validClientID(id string) bool {
+	if id == "" || len(id) > MAX_CLIENT_ID_LENGTH {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validSessionKey reports whether key looks like a session key we generated,
+// i.e. a UUID in its canonical form
+func validSessionKey(key string) bool {
+	id, err := uuid.Parse(key)
+	return err == nil && id.String() == key
+}
+
 func respondJSON(w http.ResponseWriter, statusCode int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
@@ -564,9 +1629,15 @@ func respondError(w http.ResponseWriter, statusCode int, errorMessage string) {
 // ///////////////////////////////////// HLS FUNCTIONS //////////////////////////////////////////////////////////////
 // Handle CORS preflight requests
 func handleCORS(w http.ResponseWriter) {
+	// With an allowlist the CORS middleware has already answered for the
+	// request's origin
+	if len(allowedOrigins) > 0 {
+		return
+	}
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Origin, Accept")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Origin, Accept, Range, "+settings.RequestIDHeader)
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges, "+settings.RequestIDHeader)
 }
 
 // Serve HLS master playlist (contains multiple quality variants)
@@ -578,6 +1649,7 @@ func serveHLSMasterPlaylist(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 	sessionID := vars["sessionID"]
+	logger := settings.Logger(r.Context()).With("session_id", sessionID)
 
 	// Fetch master playlist from S3
 	key := sessionID + "/" + HLS_MASTER_NAME
@@ -586,7 +1658,7 @@ func serveHLSMasterPlaylist(w http.ResponseWriter, r *http.Request) {
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		log.Printf("[serveHLSMasterPlaylist] S3 GetObject failed for key %q: %v", key, err)
+		logger.Warn("S3 GetObject failed for master playlist", "key", key, "error", err)
 		http.Error(w, "Master playlist not found", http.StatusNotFound)
 		return
 	}
@@ -594,10 +1666,90 @@ func serveHLSMasterPlaylist(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
 	io.Copy(w, obj.Body)
-	log.Printf("Served master playlist for session %s from S3", sessionID)
+	logger.Debug("Served master playlist from S3")
 	return
 }
 
+// serveHLSPoster serves the still frame taken from the video at upload time
+func serveHLSPoster(w http.ResponseWriter, r *http.Request) {
+	handleCORS(w)
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	vars := mux.Vars(r)
+	sessionID := vars["sessionID"]
+	logger := settings.Logger(r.Context()).With("session_id", sessionID)
+
+	key := sessionID + "/" + HLS_POSTER_NAME
+	if hlsDelivery == "presign" {
+		url, err := presignKey(key, presignExpiry)
+		if err == nil {
+			http.Redirect(w, r, url, http.StatusFound)
+			return
+		}
+		logger.Warn("Presigning poster failed, proxying", "key", key, "error", err)
+	}
+
+	// Fetch poster from S3
+	obj, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		logger.Warn("S3 GetObject failed for poster", "key", key, "error", err)
+		http.Error(w, "Poster not found", http.StatusNotFound)
+		return
+	}
+	defer obj.Body.Close()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	if obj.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*obj.ContentLength, 10))
+	}
+	io.Copy(w, obj.Body)
+	logger.Debug("Served poster from S3")
+}
+
+// serveHLSSubtitles serves one language's WebVTT subtitles
+func serveHLSSubtitles(w http.ResponseWriter, r *http.Request) {
+	handleCORS(w)
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	vars := mux.Vars(r)
+	sessionID := vars["sessionID"]
+	logger := settings.Logger(r.Context()).With("session_id", sessionID)
+	lang := vars["lang"]
+
+	key := sessionID + "/subtitles/" + lang + ".vtt"
+	if hlsDelivery == "presign" {
+		url, err := presignKey(key, presignExpiry)
+		if err == nil {
+			http.Redirect(w, r, url, http.StatusFound)
+			return
+		}
+		logger.Warn("Presigning subtitles failed, proxying", "key", key, "error", err)
+	}
+
+	// Fetch subtitles from S3
+	obj, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		logger.Warn("S3 GetObject failed for subtitles", "key", key, "error", err)
+		http.Error(w, "Subtitles not found", http.StatusNotFound)
+		return
+	}
+	defer obj.Body.Close()
+
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	io.Copy(w, obj.Body)
+	logger.Debug("Served subtitles from S3", "lang", lang)
+}
+
 // Add a quality-specific playlist handler
 func serveHLSQualityPlaylist(w http.ResponseWriter, r *http.Request) {
 	handleCORS(w)
@@ -607,6 +1759,7 @@ func serveHLSQualityPlaylist(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 	sessionID := vars["sessionID"]
+	logger := settings.Logger(r.Context()).With("session_id", sessionID)
 	quality := vars["quality"]
 
 	// Fetch quality playlist from S3
@@ -616,28 +1769,48 @@ func serveHLSQualityPlaylist(w http.ResponseWriter, r *http.Request) {
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		log.Printf("[serveHLSQualityPlaylist] S3 GetObject failed for key %q: %v", key, err)
+		logger.Warn("S3 GetObject failed for quality playlist", "key", key, "error", err)
 		http.Error(w, "Quality playlist not found", http.StatusNotFound)
 		return
 	}
 	defer obj.Body.Close()
 
 	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	if hlsDelivery == "presign" {
+		playlist, err := presignPlaylist(sessionID, quality, obj.Body)
+		if err == nil {
+			w.Write(playlist)
+			logger.Debug("Served presigned playlist", "quality", quality)
+			return
+		}
+		// Presigning is local signing, so this is unlikely, but the
+		// playlist body has been consumed and must be fetched again
+		logger.Warn("Presigning playlist failed, proxying", "key", key, "error", err)
+		obj, err = s3Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s3Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			http.Error(w, "Quality playlist not found", http.StatusNotFound)
+			return
+		}
+		defer obj.Body.Close()
+	}
 	io.Copy(w, obj.Body)
-	log.Printf("Served %s playlist for session %s from S3", quality, sessionID)
+	logger.Debug("Served playlist from S3", "quality", quality)
 	return
 }
 
 // Add a quality-specific segment handler
 func serveHLSQualitySegment(w http.ResponseWriter, r *http.Request) {
 	handleCORS(w)
-	log.Println("Serving quality segment from S3")
 	if r.Method == "OPTIONS" {
 		return
 	}
 
 	vars := mux.Vars(r)
 	sessionID := vars["sessionID"]
+	logger := settings.Logger(r.Context()).With("session_id", sessionID)
 	quality := vars["quality"]
 	segmentName := vars["segmentName"]
 
@@ -649,19 +1822,159 @@ func serveHLSQualitySegment(w http.ResponseWriter, r *http.Request) {
 
 	// Fetch segment from S3
 	key := sessionID + "/" + quality + "/" + segmentName
+	if serveSegment(w, r, key, "video/MP2T") {
+		logger.Debug("Served segment from S3", "quality", quality, "segment", segmentName)
+	}
+}
+
+// serveSegment sends the media segment stored under key, redirecting to S3
+// in presign mode and passing Range requests through. Reports whether the
+// segment was proxied.
+func serveSegment(w http.ResponseWriter, r *http.Request, key, contentType string) bool {
+	if hlsDelivery == "presign" {
+		url, err := presignKey(key, presignExpiry)
+		if err == nil {
+			http.Redirect(w, r, url, http.StatusFound)
+			return false
+		}
+		settings.Logger(r.Context()).Warn("Presigning segment failed, proxying", "key", key, "error", err)
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(key),
+	}
+	// S3 understands the same Range syntax, so pass it straight through
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		input.Range = aws.String(rangeHeader)
+	}
+	obj, err := s3Client.GetObject(ctx, input)
+	if err != nil {
+		var statusErr interface{ HTTPStatusCode() int }
+		if errors.As(err, &statusErr) && statusErr.HTTPStatusCode() == http.StatusRequestedRangeNotSatisfiable {
+			http.Error(w, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return false
+		}
+		settings.Logger(r.Context()).Warn("S3 GetObject failed for segment", "key", key, "error", err)
+		http.Error(w, "Segment not found", http.StatusNotFound)
+		return false
+	}
+	defer obj.Body.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Accept-Ranges", "bytes")
+	if obj.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*obj.ContentLength, 10))
+	}
+	if obj.ContentRange != nil {
+		w.Header().Set("Content-Range", *obj.ContentRange)
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	io.Copy(w, obj.Body)
+	return true
+}
+
+// serveDASHManifest serves the DASH manifest. It's always proxied, its
+// segment URLs are templates relative to it.
+func serveDASHManifest(w http.ResponseWriter, r *http.Request) {
+	handleCORS(w)
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	vars := mux.Vars(r)
+	sessionID := vars["sessionID"]
+	logger := settings.Logger(r.Context()).With("session_id", sessionID)
+
+	// Fetch manifest from S3
+	key := sessionID + "/" + DASH_DIR + "/" + DASH_MANIFEST_NAME
 	obj, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s3Bucket),
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		log.Printf("[serveHLSQualitySegment] S3 GetObject failed for key %q: %v", key, err)
-		http.Error(w, "Quality segment not found", http.StatusNotFound)
+		logger.Warn("S3 GetObject failed for DASH manifest", "key", key, "error", err)
+		http.Error(w, "DASH manifest not found", http.StatusNotFound)
 		return
 	}
 	defer obj.Body.Close()
 
-	w.Header().Set("Content-Type", "video/MP2T")
+	w.Header().Set("Content-Type", "application/dash+xml")
 	io.Copy(w, obj.Body)
-	log.Printf("Served segment %s for session %s from S3", segmentName, sessionID)
-	return
+	logger.Debug("Served DASH manifest from S3")
+}
+
+// serveDASHSegment serves a DASH init or media segment
+func serveDASHSegment(w http.ResponseWriter, r *http.Request) {
+	handleCORS(w)
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	vars := mux.Vars(r)
+	sessionID := vars["sessionID"]
+	logger := settings.Logger(r.Context()).With("session_id", sessionID)
+	segmentName := vars["segmentName"]
+
+	// Validate segment name to prevent directory traversal
+	if strings.Contains(segmentName, "..") || strings.Contains(segmentName, "/") || !strings.HasSuffix(segmentName, ".m4s") {
+		http.Error(w, "Invalid segment name", http.StatusBadRequest)
+		return
+	}
+
+	key := sessionID + "/" + DASH_DIR + "/" + segmentName
+	if serveSegment(w, r, key, "video/iso.segment") {
+		logger.Debug("Served DASH segment from S3", "segment", segmentName)
+	}
+}
+
+// presignKey returns a presigned GET URL for an object in the HLS bucket
+func presignKey(key string, expiry time.Duration) (string, error) {
+	req, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(min(expiry, MAX_PRESIGN_EXPIRY)))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// presignPlaylist rewrites the segment URIs of a quality playlist to presigned
+// S3 URLs. Each URL expires presignExpiry after its segment's start time so
+// segments near the end of a long video are still valid when they're reached.
+func presignPlaylist(sessionID, quality string, body io.Reader) ([]byte, error) {
+	var out bytes.Buffer
+	position := 0.0 // start time of the next segment in seconds
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			out.WriteString(line + "\n")
+			// #EXTINF:<duration>,[title] precedes the segment URI
+			duration, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			if !scanner.Scan() {
+				return out.Bytes(), scanner.Err()
+			}
+			segment := strings.TrimSpace(scanner.Text())
+
+			url, err := presignKey(sessionID+"/"+quality+"/"+segment,
+				presignExpiry+time.Duration(position*float64(time.Second)))
+			if err != nil {
+				return nil, err
+			}
+			out.WriteString(url + "\n")
+
+			if d, err := strconv.ParseFloat(duration, 64); err == nil {
+				position += d
+			}
+
+		default:
+			out.WriteString(line + "\n")
+		}
+	}
+
+	return out.Bytes(), scanner.Err()
 }
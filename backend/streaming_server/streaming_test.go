@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/mayank447/videosync/store"
+)
+
+// setupRedis points the server at a fresh miniredis for the test
+func setupRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	sessionStore = store.NewSessionStore(rdb)
+	t.Cleanup(func() { rdb.Close() })
+	return mr
+}
+
+// newSession creates a live session and returns its ID
+func newSession(t *testing.T) string {
+	t.Helper()
+	sessionID := uuid.New().String()
+	if _, err := sessionStore.CreateSession(ctx, sessionID, "host-token", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	return sessionID
+}
+
+// serveWebSocket starts a test server and returns its WebSocket URL. Closing
+// it waits for the handlers, which outlive their hijacked connections.
+func serveWebSocket(t *testing.T) string {
+	t.Helper()
+	var handlers sync.WaitGroup
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		handleWebSocket(w, r)
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+		handlers.Wait()
+	})
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+// dial opens a WebSocket connection closed when the test ends
+func dial(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// dialSession connects a WebSocket client to the session on a test server
+func dialSession(t *testing.T, sessionID string) *websocket.Conn {
+	t.Helper()
+	return dial(t, serveWebSocket(t)+"?sessionID="+sessionID)
+}
+
+// waitForClients waits until the session has n local clients
+func waitForClients(t *testing.T, sessionID string, n int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for len(clients.clients(sessionID)) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("session has %d clients after %v, want %d", len(clients.clients(sessionID)), timeout, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// fakeClient is a registered client without a socket, for checking what gets
+// queued to it
+func fakeClient(sessionID string) *ClientConnection {
+	return &ClientConnection{
+		conn:      &websocket.Conn{},
+		id:        uuid.New().String(),
+		sessionID: sessionID,
+		send:      make(chan []byte, 16),
+		final:     make(chan []byte, 1),
+		done:      make(chan struct{}),
+		log:       slog.Default(),
+	}
+}
+
+func TestBroadcastToSession(t *testing.T) {
+	sessionID := uuid.New().String()
+	var receivers []*ClientConnection
+	for i := 0; i < 3; i++ {
+		c := fakeClient(sessionID)
+		clients.addLimited(c, maxConnectionsPerClient)
+		t.Cleanup(func() { clients.remove(c) })
+		receivers = append(receivers, c)
+	}
+	other := fakeClient(uuid.New().String())
+	clients.addLimited(other, maxConnectionsPerClient)
+	t.Cleanup(func() { clients.remove(other) })
+
+	state := RedisState{Paused: true, CurrentTime: 42.5, PlaybackRate: 1.5, Timestamp: 1_700_000_000_000}
+	raw, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().UnixMilli()
+	broadcastState(sessionID, raw)
+
+	for i, c := range receivers {
+		if n := len(c.send); n != 1 {
+			t.Fatalf("client %d received %d messages, want 1", i, n)
+		}
+		var msg struct {
+			Type       string     `json:"type"`
+			State      RedisState `json:"state"`
+			ServerTime int64      `json:"servertime"`
+		}
+		if err := json.Unmarshal(<-c.send, &msg); err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		if msg.Type != "stateUpdate" {
+			t.Errorf("client %d received type %q, want stateUpdate", i, msg.Type)
+		}
+		if msg.State != state {
+			t.Errorf("client %d received state %+v, want %+v", i, msg.State, state)
+		}
+		if msg.ServerTime < before || msg.ServerTime > time.Now().UnixMilli() {
+			t.Errorf("client %d received servertime %d outside the broadcast", i, msg.ServerTime)
+		}
+	}
+	if n := len(other.send); n != 0 {
+		t.Errorf("client of another session received %d messages", n)
+	}
+}
+
+func TestUnansweredPingsDropClient(t *testing.T) {
+	setupRedis(t)
+	answering := newSession(t)
+	wait, period := pongWait, pingPeriod
+	pongWait, pingPeriod = 300*time.Millisecond, 100*time.Millisecond
+	// Registered first so it runs last, once the connections are closed
+	t.Cleanup(func() {
+		waitForClients(t, answering, 0, time.Second)
+		pongWait, pingPeriod = wait, period
+	})
+
+	// Reading answers pings, a client that never reads never sends a pong
+	answerConn := dialSession(t, answering)
+	go func() {
+		for {
+			if _, _, err := answerConn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	silent := newSession(t)
+	dialSession(t, silent)
+
+	waitForClients(t, answering, 1, time.Second)
+	waitForClients(t, silent, 1, time.Second)
+
+	// Past the pong deadline only the silent client is gone
+	waitForClients(t, silent, 0, 3*pongWait)
+	time.Sleep(pongWait)
+	if n := len(clients.clients(answering)); n != 1 {
+		t.Errorf("client answering pings was dropped, %d clients left", n)
+	}
+}
+
+// fakeS3 serves one object for GetObject, honoring Range like S3 does
+func fakeS3(t *testing.T, key string, body []byte) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+s3Bucket+"/"+key {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<Error><Code>NoSuchKey</Code><Message>missing</Message></Error>`)
+			return
+		}
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+			var start int
+			if _, err := fmt.Sscanf(rangeHeader, "bytes=%d-", &start); err != nil || start >= len(body) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				io.WriteString(w, `<Error><Code>InvalidRange</Code><Message>unsatisfiable</Message></Error>`)
+				return
+			}
+		}
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	s3Client = s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+}
+
+func TestServeSegmentRange(t *testing.T) {
+	s3Bucket = "videos"
+	defer func(delivery string) { hlsDelivery = delivery }(hlsDelivery)
+	hlsDelivery = "proxy"
+	body := []byte("0123456789abcdefghij")
+	fakeS3(t, "s/720p/segment0.ts", body)
+
+	tests := []struct {
+		name         string
+		rangeHeader  string
+		wantCode     int
+		wantBody     string
+		contentRange string
+	}{
+		{"full", "", http.StatusOK, string(body), ""},
+		{"range", "bytes=5-9", http.StatusPartialContent, "56789", "bytes 5-9/20"},
+		{"open range", "bytes=15-", http.StatusPartialContent, "fghij", "bytes 15-19/20"},
+		{"unsatisfiable", "bytes=50-60", http.StatusRequestedRangeNotSatisfiable, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/hls/s/720p/segment0.ts", nil)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			rec := httptest.NewRecorder()
+			serveSegment(rec, req, "s/720p/segment0.ts", "video/MP2T")
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.contentRange)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	serveSegment(rec, httptest.NewRequest("GET", "/hls/s/720p/missing.ts", nil), "s/720p/missing.ts", "video/MP2T")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("missing segment status = %d, want 404", rec.Code)
+	}
+}
+
+func TestLiveState(t *testing.T) {
+	stored := time.UnixMilli(1_700_000_000_000)
+	now := stored.Add(4 * time.Second)
+
+	tests := []struct {
+		name  string
+		state RedisState
+		want  RedisState
+	}{
+		{
+			"paused is unchanged",
+			RedisState{Paused: true, CurrentTime: 30, PlaybackRate: 1, Timestamp: stored.UnixMilli()},
+			RedisState{Paused: true, CurrentTime: 30, PlaybackRate: 1, Timestamp: stored.UnixMilli()},
+		},
+		{
+			"playing advances by the elapsed time",
+			RedisState{CurrentTime: 30, PlaybackRate: 1, Timestamp: stored.UnixMilli()},
+			RedisState{CurrentTime: 34, PlaybackRate: 1, Timestamp: now.UnixMilli()},
+		},
+		{
+			"playing advances at its rate",
+			RedisState{CurrentTime: 30, PlaybackRate: 1.5, Timestamp: stored.UnixMilli()},
+			RedisState{CurrentTime: 36, PlaybackRate: 1.5, Timestamp: now.UnixMilli()},
+		},
+		{
+			"missing rate counts as 1x",
+			RedisState{CurrentTime: 30, Timestamp: stored.UnixMilli()},
+			RedisState{CurrentTime: 34, Timestamp: now.UnixMilli()},
+		},
+		{
+			"timestamp ahead of the server clock",
+			RedisState{CurrentTime: 30, PlaybackRate: 1, Timestamp: now.Add(time.Second).UnixMilli()},
+			RedisState{CurrentTime: 30, PlaybackRate: 1, Timestamp: now.Add(time.Second).UnixMilli()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := liveState(tt.state, now); got != tt.want {
+				t.Errorf("liveState = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOversizedMessageClosesConnection(t *testing.T) {
+	setupRedis(t)
+	sessionID := newSession(t)
+	limit := maxMessageSize
+	maxMessageSize = 64
+	// Registered first so it runs last, once the connection is closed
+	t.Cleanup(func() { maxMessageSize = limit })
+
+	conn := dialSession(t, sessionID)
+	waitForClients(t, sessionID, 1, time.Second)
+
+	if err := conn.WriteMessage(websocket.TextMessage, bytes.Repeat([]byte("x"), 128)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue // participants, chat history and the like
+		}
+		if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+			t.Fatalf("read error = %v, want close 1009", err)
+		}
+		break
+	}
+	waitForClients(t, sessionID, 0, time.Second)
+}
+
+func TestKickedClientCantRejoinWithNewClientID(t *testing.T) {
+	setupRedis(t)
+	sessionID := newSession(t)
+	url := serveWebSocket(t) + "?sessionID=" + sessionID
+
+	host := dial(t, url+"&isHost=true&hostToken=host-token&clientId=host")
+	dial(t, url+"&clientId=first")
+	waitForClients(t, sessionID, 2, time.Second)
+
+	var target *ClientConnection
+	for _, c := range clients.clients(sessionID) {
+		if c.clientID == "first" {
+			target = c
+		}
+	}
+	if target == nil {
+		t.Fatal("participant not registered")
+	}
+	if err := host.WriteJSON(map[string]string{"type": "kick", "targetId": target.id}); err != nil {
+		t.Fatal(err)
+	}
+	waitForClients(t, sessionID, 1, time.Second)
+
+	// Same address, new clientId
+	conn, resp, err := websocket.DefaultDialer.Dial(url+"&clientId=second", nil)
+	if err == nil {
+		conn.Close()
+		t.Fatal("kicked client rejoined with a new clientId")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("rejoin response = %v, want 403", resp)
+	}
+}
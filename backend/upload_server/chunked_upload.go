@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mayank447/videosync/settings"
+)
+
+// Chunked uploads let large videos be sent in pieces that can be retried:
+//
+//	POST /api/video/{sessionID}/init                       {"filename": "movie.mp4", "format": "both", "chunkDuration": 2} -> {"uploadID": "..."}
+//	PUT  /api/video/{sessionID}/{uploadID}/chunk/{n}       raw bytes of chunk n, starting at 1
+//	POST /api/video/{sessionID}/{uploadID}/complete        assembles the chunks and starts transcoding
+//
+// Chunks are passed straight through to an S3 multipart upload, so every
+// chunk but the last must be at least 5 MB. Re-sending a chunk replaces it,
+// until complete is called.
+// Transcoding runs in the background, progress is on /api/video/{sessionID}/status.
+// The assembled source is deleted once it's transcoded, and the cleanup sweep
+// aborts multipart uploads that outlive CHUNKED_UPLOAD_TTL without completing.
+
+const (
+	MAX_CHUNK_SIZE      = 512 << 20 // 512 MB per chunk
+	MAX_CHUNK_COUNT     = 10000     // S3 multipart part limit
+	CHUNKED_UPLOAD_TTL  = 24 * time.Hour
+	SOURCE_URL_EXPIRY   = 6 * time.Hour // how long ffmpeg may read the assembled source
+	CHUNKED_SOURCE_NAME = "source"
+)
+
+// Transcodes of completed chunked uploads, waited for on shutdown
+var backgroundJobs sync.WaitGroup
+
+// handleChunkedInit starts a multipart upload of the source video to S3
+func handleChunkedInit(w http.ResponseWriter, r *http.Request) {
+	handleCORS(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	sessionID := mux.Vars(r)["sessionID"]
+	logger := settings.Logger(r.Context()).With("session_id", sessionID)
+	if !requireLiveSession(w, sessionID) {
+		return
+	}
+
+	var req struct {
+		Filename      string `json:"filename"`
+		Format        string `json:"format"`        // hls, dash or both, also accepted as ?format=
+		ChunkDuration int    `json:"chunkDuration"` // seconds, also accepted as ?chunkDuration=
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	filename, err := validateFilename(req.Filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Format == "" {
+		req.Format = r.URL.Query().Get("format")
+	}
+	chunkDuration := r.URL.Query().Get("chunkDuration")
+	if req.ChunkDuration != 0 {
+		chunkDuration = strconv.Itoa(req.ChunkDuration)
+	}
+	opts, err := parseUploadOptions(req.Format, chunkDuration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	uploadID := uuid.New().String()
+	key := sessionID + "/" + CHUNKED_SOURCE_NAME + "/" + uploadID + "/" + filename
+	out, err := s3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: &bucket,
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		logger.Error("creating multipart upload", "error", err)
+		http.Error(w, "could not start upload", http.StatusInternalServerError)
+		return
+	}
+
+	uploadKey := "upload:" + uploadID
+	err = rdb.HSet(ctx, uploadKey,
+		"sessionID", sessionID,
+		"filename", filename,
+		"key", key,
+		"s3UploadID", *out.UploadId,
+		"format", strings.Join(opts.Formats.names(), ","),
+		"chunkDuration", opts.ChunkDuration,
+	).Err()
+	if err == nil {
+		err = rdb.Expire(ctx, uploadKey, CHUNKED_UPLOAD_TTL).Err()
+	}
+	if err != nil {
+		logger.Error("storing upload", "upload_id", uploadID, "error", err)
+		abortChunkedUpload(uploadID, key, *out.UploadId)
+		http.Error(w, "could not start upload", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("started chunked upload", "upload_id", uploadID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"sessionID": sessionID,
+		"uploadID":  uploadID,
+	})
+}
+
+// handleChunkUpload uploads one chunk as the matching S3 part. Retrying a
+// chunk overwrites the part and its recorded ETag, so retries are idempotent.
+func handleChunkUpload(w http.ResponseWriter, r *http.Request) {
+	handleCORS(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	vars := mux.Vars(r)
+	logger := settings.Logger(r.Context()).With("session_id", vars["sessionID"], "upload_id", vars["uploadID"])
+	if !requireLiveSession(w, vars["sessionID"]) {
+		return
+	}
+	upload, ok := getChunkedUpload(w, vars["sessionID"], vars["uploadID"])
+	if !ok {
+		return
+	}
+	// The multipart upload is being assembled or is gone, a late part
+	// would be lost
+	if upload["completed"] != "" {
+		http.Error(w, "upload already completed", http.StatusConflict)
+		return
+	}
+
+	n, err := strconv.Atoi(vars["n"])
+	if err != nil || n < 1 || n > MAX_CHUNK_COUNT {
+		http.Error(w, "chunk number must be between 1 and 10000", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength < 0 {
+		http.Error(w, "Content-Length required", http.StatusLengthRequired)
+		return
+	}
+	if r.ContentLength > MAX_CHUNK_SIZE {
+		http.Error(w, "Chunk too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	out, err := s3Client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        &bucket,
+		Key:           aws.String(upload["key"]),
+		UploadId:      aws.String(upload["s3UploadID"]),
+		PartNumber:    aws.Int32(int32(n)),
+		ContentLength: aws.Int64(r.ContentLength),
+		Body:          http.MaxBytesReader(w, r.Body, r.ContentLength),
+	})
+	if err != nil {
+		logger.Error("uploading chunk", "chunk", n, "error", err)
+		http.Error(w, "failed uploading chunk", http.StatusBadGateway)
+		return
+	}
+
+	if err := rdb.HSet(ctx, "upload:"+vars["uploadID"]+":parts", n, *out.ETag).Err(); err != nil {
+		logger.Error("recording chunk", "chunk", n, "error", err)
+		http.Error(w, "failed recording chunk", http.StatusInternalServerError)
+		return
+	}
+	rdb.Expire(ctx, "upload:"+vars["uploadID"]+":parts", CHUNKED_UPLOAD_TTL)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleChunkedComplete assembles the chunks in S3 and transcodes the result
+// in the background, reading the source straight from S3
+func handleChunkedComplete(w http.ResponseWriter, r *http.Request) {
+	handleCORS(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	vars := mux.Vars(r)
+	sessionID, uploadID := vars["sessionID"], vars["uploadID"]
+	logger := settings.Logger(r.Context()).With("session_id", sessionID, "upload_id", uploadID)
+	upload, ok := getChunkedUpload(w, sessionID, uploadID)
+	if !ok {
+		return
+	}
+
+	parts, err := chunkedParts(uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only the first complete call assembles the upload
+	first, err := rdb.HSetNX(ctx, "upload:"+uploadID, "completed", time.Now().Unix()).Result()
+	if err != nil {
+		http.Error(w, "could not complete upload", http.StatusInternalServerError)
+		return
+	}
+	if !first {
+		http.Error(w, "upload already completed", http.StatusConflict)
+		return
+	}
+
+	_, err = s3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &bucket,
+		Key:             aws.String(upload["key"]),
+		UploadId:        aws.String(upload["s3UploadID"]),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		logger.Error("completing upload", "error", err)
+		rdb.HDel(ctx, "upload:"+uploadID, "completed")
+		http.Error(w, "failed assembling upload", http.StatusBadGateway)
+		return
+	}
+
+	source, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    aws.String(upload["key"]),
+	}, s3.WithPresignExpires(SOURCE_URL_EXPIRY))
+	if err != nil {
+		logger.Error("presigning source", "error", err)
+		deleteChunkedSource(uploadID, upload["key"])
+		http.Error(w, "could not read upload", http.StatusInternalServerError)
+		return
+	}
+
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		// The source is only read while transcoding, a failed upload has
+		// to be sent again anyway
+		defer deleteChunkedSource(uploadID, upload["key"])
+
+		tmpDir, err := os.MkdirTemp("", "videosync-"+sessionID+"-")
+		if err != nil {
+			logger.Error("making temp dir", "error", err)
+			publishStatus(sessionID, UploadStatus{Stage: "failed"})
+			return
+		}
+		defer os.RemoveAll(tmpDir)
+
+		// Uploads started before these options existed have none recorded,
+		// and get the defaults
+		opts, err := parseUploadOptions(upload["format"], upload["chunkDuration"])
+		if err != nil {
+			logger.Warn("ignoring stored upload options", "error", err)
+			opts, _ = parseUploadOptions("", "")
+		}
+		if _, err := processVideo(logger, sessionID, source.URL, upload["filename"], tmpDir, opts); err != nil {
+			logger.Error("processing chunked upload", "error", err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"sessionID": sessionID,
+		"uploadID":  uploadID,
+		"statusURL": "/api/video/" + sessionID + "/status",
+	})
+}
+
+// abortChunkedUpload gives up on an upload, dropping its parts from S3 and
+// its records
+func abortChunkedUpload(uploadID, key, s3UploadID string) {
+	_, err := s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &bucket,
+		Key:      aws.String(key),
+		UploadId: aws.String(s3UploadID),
+	})
+	if err != nil {
+		slog.Error("aborting multipart upload", "upload_id", uploadID, "error", err)
+	}
+	rdb.Del(ctx, "upload:"+uploadID, "upload:"+uploadID+":parts")
+}
+
+// deleteChunkedSource removes an assembled upload from S3 and its records
+func deleteChunkedSource(uploadID, key string) {
+	_, err := s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &bucket,
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		slog.Error("deleting chunked upload source", "upload_id", uploadID, "error", err)
+	}
+	rdb.Del(ctx, "upload:"+uploadID, "upload:"+uploadID+":parts")
+}
+
+// chunkedUploadID returns the upload ID in the key of an upload's source,
+// {sessionID}/source/{uploadID}/{filename}
+func chunkedUploadID(key string) (string, bool) {
+	parts := strings.SplitN(key, "/", 4)
+	if len(parts) != 4 || parts[1] != CHUNKED_SOURCE_NAME {
+		return "", false
+	}
+	return parts[2], true
+}
+
+// getChunkedUpload loads an upload, writing a 404 if it doesn't belong to the session
+func getChunkedUpload(w http.ResponseWriter, sessionID, uploadID string) (map[string]string, bool) {
+	upload, err := rdb.HGetAll(ctx, "upload:"+uploadID).Result()
+	if err != nil {
+		slog.Error("getting upload", "upload_id", uploadID, "error", err)
+		http.Error(w, "could not read upload", http.StatusInternalServerError)
+		return nil, false
+	}
+	if len(upload) == 0 || upload["sessionID"] != sessionID {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, false
+	}
+	return upload, true
+}
+
+// chunkedParts returns the uploaded parts in order, requiring chunks 1..N
+func chunkedParts(uploadID string) ([]types.CompletedPart, error) {
+	etags, err := rdb.HGetAll(ctx, "upload:"+uploadID+":parts").Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(etags) == 0 {
+		return nil, errors.New("no chunks uploaded")
+	}
+
+	numbers := make([]int, 0, len(etags))
+	for field := range etags {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	parts := make([]types.CompletedPart, 0, len(numbers))
+	for i, n := range numbers {
+		if n != i+1 {
+			return nil, errors.New("missing chunk " + strconv.Itoa(i+1))
+		}
+		parts = append(parts, types.CompletedPart{
+			ETag:       aws.String(etags[strconv.Itoa(n)]),
+			PartNumber: aws.Int32(int32(n)),
+		})
+	}
+	return parts, nil
+}
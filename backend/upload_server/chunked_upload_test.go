@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/mayank447/videosync/store"
+)
+
+// setupRedis points the server at a fresh miniredis for the test
+func setupRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	sessionStore = store.NewSessionStore(rdb)
+	t.Cleanup(func() { rdb.Close() })
+	return mr
+}
+
+func TestChunkedInitRequiresLiveSession(t *testing.T) {
+	setupRedis(t)
+
+	tests := []struct {
+		name      string
+		sessionID string
+		wantCode  int
+	}{
+		{"not a uuid", "../other", http.StatusBadRequest},
+		{"not canonical", strings.ToUpper(uuid.New().String()), http.StatusBadRequest},
+		{"unknown session", uuid.New().String(), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/video/"+tt.sessionID+"/init", strings.NewReader(`{"filename": "movie.mp4"}`))
+			req = mux.SetURLVars(req, map[string]string{"sessionID": tt.sessionID})
+			rec := httptest.NewRecorder()
+			handleChunkedInit(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+		})
+	}
+}
+
+func TestChunkAfterCompleteConflicts(t *testing.T) {
+	setupRedis(t)
+	sessionID := uuid.New().String()
+	if _, err := sessionStore.CreateSession(ctx, sessionID, "host-token", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	uploadID := uuid.New().String()
+	err := rdb.HSet(ctx, "upload:"+uploadID,
+		"sessionID", sessionID,
+		"key", sessionID+"/source/"+uploadID+"/movie.mp4",
+		"s3UploadID", "s3-upload",
+		"completed", time.Now().Unix(),
+	).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("PUT", "/api/video/"+sessionID+"/"+uploadID+"/chunk/1", strings.NewReader("late part"))
+	req = mux.SetURLVars(req, map[string]string{"sessionID": sessionID, "uploadID": uploadID, "n": "1"})
+	rec := httptest.NewRecorder()
+	handleChunkUpload(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("status = %d, want 409: %s", rec.Code, rec.Body)
+	}
+}
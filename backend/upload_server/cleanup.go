@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+)
+
+// Uploaded videos live in S3 under {sessionID}/. They are removed right away
+// when the host ends a session, and a periodic sweep removes the prefixes of
+// sessions whose Redis keys have expired. A prefix is only swept once its
+// session has been gone for the grace period, so a session that's briefly
+// missing (e.g. a reconnect racing an expiry) isn't wiped. The sweep also
+// aborts chunked uploads whose records expired before they were completed,
+// since S3 keeps and bills their parts until then.
+
+const (
+	SESSION_ENDED_CHANNEL    = "session-ended"
+	DEFAULT_CLEANUP_INTERVAL = 15 * time.Minute // override with CLEANUP_INTERVAL
+	DEFAULT_CLEANUP_GRACE    = 1 * time.Hour    // override with CLEANUP_GRACE_PERIOD
+	DELETE_BATCH_SIZE        = 1000             // DeleteObjects limit
+)
+
+var (
+	cleanupInterval = DEFAULT_CLEANUP_INTERVAL
+	cleanupGrace    = DEFAULT_CLEANUP_GRACE
+
+	// first time each orphaned prefix was seen without a live session
+	orphanedSince = make(map[string]time.Time)
+)
+
+// listenForEndedSessions deletes a session's objects as soon as the main
+// server reports that its host ended it
+func listenForEndedSessions() {
+	sub := rdb.Subscribe(ctx, SESSION_ENDED_CHANNEL)
+	defer sub.Close()
+
+	for msg := range sub.Channel() {
+		sessionID := msg.Payload
+		if _, err := uuid.Parse(sessionID); err != nil {
+			slog.Warn("ignoring ended session with invalid ID", "session_id", sessionID)
+			continue
+		}
+		if err := deleteSessionObjects(sessionID); err != nil {
+			slog.Error("cleanup of ended session", "session_id", sessionID, "error", err)
+		}
+	}
+}
+
+// sweepExpiredSessions periodically removes the objects of expired sessions
+func sweepExpiredSessions() {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := sweepOnce(); err != nil {
+			slog.Error("cleanup sweep", "error", err)
+		}
+	}
+}
+
+func sweepOnce() error {
+	now := time.Now()
+	seen := make(map[string]bool)
+
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket:    &bucket,
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, prefix := range page.CommonPrefixes {
+			sessionID := strings.TrimSuffix(aws.ToString(prefix.Prefix), "/")
+			// Leave anything that isn't a session alone
+			if _, err := uuid.Parse(sessionID); err != nil {
+				continue
+			}
+			seen[sessionID] = true
+
+			live, err := sessionStore.Exists(ctx, sessionID)
+			if err != nil {
+				return err
+			}
+			if live {
+				delete(orphanedSince, sessionID)
+				continue
+			}
+
+			since, ok := orphanedSince[sessionID]
+			if !ok {
+				orphanedSince[sessionID] = now
+				since = now
+			}
+			if now.Sub(since) < cleanupGrace {
+				continue
+			}
+
+			if err := deleteSessionObjects(sessionID); err != nil {
+				slog.Error("cleanup of expired session", "session_id", sessionID, "error", err)
+				continue
+			}
+			delete(orphanedSince, sessionID)
+		}
+	}
+
+	// Forget prefixes that were removed some other way
+	for sessionID := range orphanedSince {
+		if !seen[sessionID] {
+			delete(orphanedSince, sessionID)
+		}
+	}
+
+	return abortMultipartUploads("", now.Add(-CHUNKED_UPLOAD_TTL))
+}
+
+// abortMultipartUploads aborts the unfinished multipart uploads under prefix
+// that were started before initiatedBefore
+func abortMultipartUploads(prefix string, initiatedBefore time.Time) error {
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: &bucket,
+		Prefix: aws.String(prefix),
+	}
+	aborted := 0
+	for {
+		page, err := s3Client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			return err
+		}
+		for _, upload := range page.Uploads {
+			if upload.Initiated != nil && !upload.Initiated.Before(initiatedBefore) {
+				continue
+			}
+			// Leave anything that isn't a chunked upload alone
+			uploadID, ok := chunkedUploadID(aws.ToString(upload.Key))
+			if !ok {
+				continue
+			}
+			abortChunkedUpload(uploadID, aws.ToString(upload.Key), aws.ToString(upload.UploadId))
+			aborted++
+		}
+		if !aws.ToBool(page.IsTruncated) {
+			break
+		}
+		input.KeyMarker = page.NextKeyMarker
+		input.UploadIdMarker = page.NextUploadIdMarker
+	}
+
+	if aborted > 0 {
+		slog.Info("aborted multipart uploads", "prefix", prefix, "aborted", aborted)
+	}
+	return nil
+}
+
+// deleteSessionObjects removes everything under {sessionID}/ in the bucket,
+// including uploads still in progress. Objects S3 refuses to delete are
+// logged and make it return an error, so the sweep tries them again.
+func deleteSessionObjects(sessionID string) error {
+	if err := abortMultipartUploads(sessionID+"/", time.Now()); err != nil {
+		return err
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: aws.String(sessionID + "/"),
+	})
+
+	deleted, failed := 0, 0
+	batch := make([]types.ObjectIdentifier, 0, DELETE_BATCH_SIZE)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		// Quiet still reports the keys that couldn't be deleted
+		out, err := s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: &bucket,
+			Delete: &types.Delete{Objects: batch, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		for _, e := range out.Errors {
+			slog.Error("deleting object", "session_id", sessionID, "key", aws.ToString(e.Key),
+				"code", aws.ToString(e.Code), "error", aws.ToString(e.Message))
+		}
+		failed += len(out.Errors)
+		deleted += len(batch) - len(out.Errors)
+		batch = batch[:0]
+		return nil
+	}
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			batch = append(batch, types.ObjectIdentifier{Key: obj.Key})
+			if len(batch) == DELETE_BATCH_SIZE {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	slog.Info("removed session objects", "session_id", sessionID, "deleted", deleted)
+	if failed > 0 {
+		return fmt.Errorf("could not delete %d objects", failed)
+	}
+	return nil
+}
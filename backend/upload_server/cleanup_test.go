@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+// fakeBucket is an in-memory S3 bucket answering the listing and batch
+// delete calls the cleanup makes. Keys in refused fail to delete.
+type fakeBucket struct {
+	mu      sync.Mutex
+	objects map[string]bool
+	refused map[string]bool
+}
+
+// keys returns the keys in the bucket, sorted
+func (b *fakeBucket) keys() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var keys []string
+	for key := range b.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	switch {
+	case q.Has("uploads"):
+		fmt.Fprint(w, `<ListMultipartUploadsResult><IsTruncated>false</IsTruncated></ListMultipartUploadsResult>`)
+
+	case q.Has("delete"):
+		var req struct {
+			Objects []struct {
+				Key string `xml:"Key"`
+			} `xml:"Object"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		fmt.Fprint(w, `<DeleteResult>`)
+		for _, obj := range req.Objects {
+			if b.refused[obj.Key] {
+				fmt.Fprintf(w, `<Error><Key>%s</Key><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`, obj.Key)
+				continue
+			}
+			delete(b.objects, obj.Key)
+		}
+		fmt.Fprint(w, `</DeleteResult>`)
+
+	default:
+		prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+		fmt.Fprint(w, `<ListBucketResult><IsTruncated>false</IsTruncated>`)
+		seen := make(map[string]bool)
+		for _, key := range b.keys() {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			rest := strings.TrimPrefix(key, prefix)
+			if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+				if common := prefix + rest[:i+1]; !seen[common] {
+					seen[common] = true
+					fmt.Fprintf(w, `<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>`, common)
+				}
+				continue
+			}
+			fmt.Fprintf(w, `<Contents><Key>%s</Key></Contents>`, key)
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+	}
+}
+
+// serveBucket points the server's S3 client at b
+func serveBucket(t *testing.T, b *fakeBucket) {
+	t.Helper()
+	srv := httptest.NewServer(b)
+	t.Cleanup(srv.Close)
+
+	bucket = "videos"
+	s3Client = s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+}
+
+func TestSweepRetriesObjectsThatFailedToDelete(t *testing.T) {
+	setupRedis(t)
+	defer func(grace time.Duration) { cleanupGrace = grace }(cleanupGrace)
+	cleanupGrace = 0
+
+	sessionID := uuid.New().String()
+	stuck := sessionID + "/720p/segment_001.ts"
+	b := &fakeBucket{
+		objects: map[string]bool{
+			sessionID + "/master.m3u8":         true,
+			sessionID + "/720p/segment_000.ts": true,
+			stuck:                              true,
+		},
+		refused: map[string]bool{stuck: true},
+	}
+	serveBucket(t, b)
+
+	if err := sweepOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if left := b.keys(); len(left) != 1 || left[0] != stuck {
+		t.Fatalf("objects left after the first sweep: %v", left)
+	}
+	if _, ok := orphanedSince[sessionID]; !ok {
+		t.Fatal("session with an undeleted object was forgotten")
+	}
+
+	// Once S3 lets go of the object the next sweep removes it
+	b.mu.Lock()
+	delete(b.refused, stuck)
+	b.mu.Unlock()
+	if err := sweepOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if left := b.keys(); len(left) != 0 {
+		t.Errorf("objects left after the second sweep: %v", left)
+	}
+	if _, ok := orphanedSince[sessionID]; ok {
+		t.Error("cleaned up session still tracked as orphaned")
+	}
+}
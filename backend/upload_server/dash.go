@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Besides HLS an upload can be packaged as MPEG-DASH for players like dash.js.
+// The DASH output has the same video qualities and audio as the HLS variants,
+// as fragmented MP4 under {sessionID}/dash/ with one manifest.mpd.
+
+const (
+	DASH_DIR           = "dash"
+	DASH_MANIFEST_NAME = "manifest.mpd"
+)
+
+// outputFormats are the streaming formats to package an upload as
+type outputFormats struct {
+	HLS  bool
+	DASH bool
+}
+
+// parseFormats reads the format of an upload: hls, dash, both, or a comma
+// separated list of hls and dash. Empty means hls.
+func parseFormats(value string) (outputFormats, error) {
+	var f outputFormats
+	if strings.TrimSpace(value) == "" {
+		f.HLS = true
+		return f, nil
+	}
+	for _, name := range strings.Split(strings.ToLower(value), ",") {
+		switch strings.TrimSpace(name) {
+		case "hls":
+			f.HLS = true
+		case "dash":
+			f.DASH = true
+		case "both":
+			f.HLS, f.DASH = true, true
+		default:
+			return f, fmt.Errorf("unknown format %q", name)
+		}
+	}
+	return f, nil
+}
+
+// names lists the formats, as stored in the manifest
+func (f outputFormats) names() []string {
+	var names []string
+	if f.HLS {
+		names = append(names, "hls")
+	}
+	if f.DASH {
+		names = append(names, "dash")
+	}
+	return names
+}
+
+// qualities lists the variant names the manifest offers, highest first. They
+// name HLS playlists, so a DASH-only upload offers none and its player picks
+// the quality from the DASH manifest instead.
+func (f outputFormats) qualities(outputs []hlsVariant) []string {
+	qualities := []string{}
+	if !f.HLS {
+		return qualities
+	}
+	for _, v := range outputs {
+		qualities = append(qualities, v.Name)
+	}
+	return qualities
+}
+
+// transcodeDASH encodes every video variant and the audio, when there is one,
+// into a single DASH presentation in dashDir. Keyframes are forced at segment
+// boundaries, every chunkDuration seconds, so players can switch quality
+// between any two segments.
+func transcodeDASH(ctx context.Context, sessionID, srcPath, dashDir string, duration float64, chunkDuration int, outputs []hlsVariant) error {
+	if err := os.MkdirAll(dashDir, 0755); err != nil {
+		return err
+	}
+
+	args := []string{"-i", srcPath}
+	var video []hlsVariant
+	var audio *hlsVariant
+	for i, v := range outputs {
+		if v.audioOnly() {
+			audio = &outputs[i]
+			continue
+		}
+		video = append(video, v)
+		args = append(args, "-map", "0:v:0")
+	}
+	if audio != nil {
+		args = append(args, "-map", "0:a:0")
+	}
+	if len(video) == 0 {
+		return errors.New("no video variants")
+	}
+
+	args = append(args, "-c:v", "libx264",
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", chunkDuration))
+	for i, v := range video {
+		n := strconv.Itoa(i)
+		args = append(args,
+			"-b:v:"+n, fmt.Sprintf("%dk", v.Bandwidth/1000),
+			"-s:v:"+n, v.Resolution,
+		)
+	}
+	adaptationSets := "id=0,streams=v"
+	if audio != nil {
+		args = append(args, "-c:a", "aac", "-b:a", fmt.Sprintf("%dk", audio.Bandwidth/1000))
+		adaptationSets += " id=1,streams=a"
+	}
+	args = append(args,
+		"-f", "dash",
+		"-seg_duration", strconv.Itoa(chunkDuration),
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		"-adaptation_sets", adaptationSets,
+		filepath.Join(dashDir, DASH_MANIFEST_NAME),
+	)
+
+	progress := func(percent int) {
+		publishStatus(sessionID, UploadStatus{Stage: "transcoding", Variant: DASH_DIR, Percent: percent})
+	}
+	timer := prometheus.NewTimer(transcodeDuration.WithLabelValues(DASH_DIR))
+	defer timer.ObserveDuration()
+	if err := runFFmpeg(ctx, args, duration, progress); err != nil {
+		os.RemoveAll(dashDir)
+		return err
+	}
+	return nil
+}
+
+// verifyDASH checks that the manifest was written along with an init segment
+// and at least one media segment
+func verifyDASH(dashDir string) error {
+	info, err := os.Stat(filepath.Join(dashDir, DASH_MANIFEST_NAME))
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return errors.New("manifest is empty")
+	}
+	for _, pattern := range []string{"init-*.m4s", "chunk-*.m4s"} {
+		matches, err := filepath.Glob(filepath.Join(dashDir, pattern))
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("no %s segments", pattern)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	uploadsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "videosync_uploads_total",
+		Help: "Uploaded videos processed, by result.",
+	}, []string{"result"})
+	uploadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "videosync_upload_duration_seconds",
+		Help:    "Time from receiving an upload to the HLS output being in S3.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14), // 1s to ~2h
+	})
+	transcodeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "videosync_transcode_duration_seconds",
+		Help:    "ffmpeg run time per quality variant.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"variant"})
+	redisErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "videosync_redis_errors_total",
+		Help: "Failed Redis commands.",
+	})
+)
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mayank447/videosync/settings"
+)
+
+// Subtitles are uploaded separately from the video, one language at a time:
+//
+//	POST /api/video/{sessionID}/subtitles   multipart form: lang=en, label=English (optional), subtitles=<.vtt or .srt file>
+//
+// SubRip files are converted to WebVTT. Each language is stored in S3 as
+// {sessionID}/subtitles/{lang}.vtt and listed in the session's manifest;
+// uploading a language again replaces it.
+
+const (
+	MAX_SUBTITLE_SIZE  = 5 << 20 // 5 MB
+	MAX_SUBTITLE_LABEL = 64
+)
+
+// BCP 47 style language tags, e.g. "en" or "pt-BR"
+var langPattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// handleSubtitleUpload stores a subtitle track for the session's video
+func handleSubtitleUpload(w http.ResponseWriter, r *http.Request) {
+	handleCORS(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	sessionID := mux.Vars(r)["sessionID"]
+	logger := settings.Logger(r.Context()).With("session_id", sessionID)
+	if !requireLiveSession(w, sessionID) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_SUBTITLE_SIZE)
+	if err := r.ParseMultipartForm(MAX_SUBTITLE_SIZE); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "expected multipart form", http.StatusBadRequest)
+		}
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	lang := r.FormValue("lang")
+	if !langPattern.MatchString(lang) {
+		http.Error(w, "lang must be a language code like en or pt-BR", http.StatusBadRequest)
+		return
+	}
+	label := strings.TrimSpace(r.FormValue("label"))
+	if len(label) > MAX_SUBTITLE_LABEL {
+		http.Error(w, "label too long", http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("subtitles")
+	if err != nil {
+		http.Error(w, "missing 'subtitles' form field", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	filename, err := validateFilename(header.Filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tmpDir, err := os.MkdirTemp("", "videosync-"+sessionID+"-")
+	if err != nil {
+		http.Error(w, "could not make temp dir", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	vttPath := filepath.Join(tmpDir, lang+".vtt")
+	if err := saveSubtitles(logger, file, filename, vttPath); err != nil {
+		logger.Warn("rejecting subtitles", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key := sessionID + "/subtitles/" + lang + ".vtt"
+	if err := uploadFile(vttPath, key); err != nil {
+		logger.Error("uploading subtitles", "key", key, "error", err)
+		http.Error(w, "failed uploading subtitles", http.StatusInternalServerError)
+		return
+	}
+
+	subtitle := Subtitle{Lang: lang, Label: label, Path: "/hls/" + key}
+	err = updateManifest(sessionID, func(manifest *VideoManifest) {
+		for i, existing := range manifest.Subtitles {
+			if strings.EqualFold(existing.Lang, lang) {
+				manifest.Subtitles[i] = subtitle
+				return
+			}
+		}
+		manifest.Subtitles = append(manifest.Subtitles, subtitle)
+	})
+	if err != nil {
+		logger.Error("adding subtitles to manifest", "error", err)
+		http.Error(w, "failed recording subtitles", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("stored subtitles", "lang", lang)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(subtitle)
+}
+
+// saveSubtitles writes the uploaded subtitles to vttPath as WebVTT,
+// converting SubRip with ffmpeg
+func saveSubtitles(logger *slog.Logger, src io.Reader, filename, vttPath string) error {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".vtt":
+		data, err := io.ReadAll(src)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(strings.TrimPrefix(string(data), "\ufeff"), "WEBVTT") {
+			return errors.New("not a WebVTT file")
+		}
+		return os.WriteFile(vttPath, data, 0644)
+
+	case ".srt":
+		srtPath := strings.TrimSuffix(vttPath, ".vtt") + ".srt"
+		dst, err := os.Create(srtPath)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, src)
+		dst.Close()
+		if err != nil {
+			return err
+		}
+
+		out, err := exec.CommandContext(ctx, "ffmpeg",
+			"-i", srtPath,
+			"-f", "webvtt",
+			"-y", vttPath,
+		).CombinedOutput()
+		if err != nil {
+			logger.Warn("ffmpeg converting subtitles", "filename", filename, "error", err, "output", string(bytes.TrimSpace(out)))
+			return errors.New("could not convert subtitles")
+		}
+		return nil
+	}
+	return errors.New("subtitles must be a .vtt or .srt file")
+}
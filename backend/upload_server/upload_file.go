@@ -1,71 +1,140 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/mayank447/videosync/settings"
+	"github.com/mayank447/videosync/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
-	MAX_UPLOAD_SIZE  = 100 << 20 // 100 MB
-	REDIS_MSG_EXPIRY = 24 * time.Hour
+	DEFAULT_MAX_UPLOAD_MB     = 4096 // 4 GB, override with MAX_UPLOAD_SIZE_MB
+	DEFAULT_S3_WORKERS        = 8    // parallel S3 uploads, override with S3_UPLOAD_WORKERS
+	DEFAULT_TRANSCODE_WORKERS = 2    // parallel ffmpeg runs, override with TRANSCODE_WORKERS
+	REDIS_MSG_EXPIRY          = 24 * time.Hour
+	HEALTH_CHECK_TIMEOUT      = 2 * time.Second
+	DEFAULT_CHUNK_DURATION    = 5 // segment length in seconds, override per upload with chunkDuration
+	MIN_CHUNK_DURATION        = 1
+	MAX_CHUNK_DURATION        = 30
+	POSTER_NAME               = "poster.jpg"
+	POSTER_POSITION           = 0.1 // poster frame position as a fraction of the duration
+	MANIFEST_UPDATE_RETRIES   = 5
+	FFMPEG_STDERR_TAIL        = 4 << 10 // bytes of ffmpeg's stderr kept for errors
 )
 
-var (
-	bucket   string
-	uploader *manager.Uploader
+// hlsVariant is one quality rendition of the HLS output
+type hlsVariant struct {
+	Name       string
+	Resolution string // empty for the audio-only rendition
+	Bandwidth  int
+}
 
-	// Redis globals
-	rdb *redis.Client
-	ctx = context.Background()
-)
+// Define qualities in descending order
+var variants = []hlsVariant{
+	{"720p", "1280x720", 2800000},
+	{"480p", "854x480", 1400000},
+	{"360p", "640x360", 800000},
+	{"audio", "", 128000}, // for listeners on very slow connections
+}
 
-// init() will run before main()
-func init() {
-	// must export S3_BUCKET + AWS_REGION + AWS credentials in env
-	bucket = "videosync-mayank447"
-	region := "eu-north-1"
+func (v hlsVariant) audioOnly() bool { return v.Resolution == "" }
 
-	// load AWS SDK config
-	cfg, err := config.LoadDefaultConfig(context.Background(),
-		config.WithRegion(region),
-	)
-	if err != nil {
-		log.Fatalf("unable to load AWS SDK config: %v", err)
+// variantsFor returns the renditions to make of a source, leaving out the
+// audio-only one when the source is silent
+func variantsFor(hasAudio bool) []hlsVariant {
+	var out []hlsVariant
+	for _, v := range variants {
+		if v.audioOnly() && !hasAudio {
+			continue
+		}
+		out = append(out, v)
 	}
+	return out
+}
 
-	// create a high-level uploader
-	uploader = manager.NewUploader(s3.NewFromConfig(cfg))
+// VideoManifest describes an uploaded video, stored under session:{id}:manifest
+type VideoManifest struct {
+	ChunkDuration int        `json:"chunkDuration"` // Duration in seconds
+	ChunkCount    int        `json:"chunkCount"`
+	VideoDuration float64    `json:"videoDuration"` // Duration in seconds
+	VideoFileType string     `json:"videoFileType"`
+	Qualities     []string   `json:"qualities"`         // HLS variant names, highest first
+	Formats       []string   `json:"formats,omitempty"` // hls and/or dash
+	DASH          string     `json:"dash,omitempty"`    // path of the DASH manifest on the streaming server
+	Poster        string     `json:"poster,omitempty"`  // path of the poster image on the streaming server
+	Subtitles     []Subtitle `json:"subtitles,omitempty"`
+}
 
-	// initialize Redis client
-	rdb = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
-	})
+// Subtitle is one WebVTT subtitle track of a session's video
+type Subtitle struct {
+	Lang  string `json:"lang"`
+	Label string `json:"label,omitempty"`
+	Path  string `json:"path"` // path of the .vtt file on the streaming server
 }
 
-// handleCORS sets permissive CORS headers
+var (
+	bucket        string
+	region        string
+	s3Client      *s3.Client
+	presignClient *s3.PresignClient
+	uploader      *manager.Uploader
+
+	maxUploadSize    = int64(DEFAULT_MAX_UPLOAD_MB) << 20
+	s3Workers        = DEFAULT_S3_WORKERS
+	transcodeWorkers = DEFAULT_TRANSCODE_WORKERS
+
+	// Origins allowed by ALLOWED_ORIGINS, empty allows every origin
+	allowedOrigins []string
+
+	// Redis globals
+	rdb *redis.Client
+
+	// Session keys in Redis, see the store package
+	sessionStore *store.SessionStore
+
+	ctx = context.Background()
+)
+
+// handleCORS sets permissive CORS headers when no origin allowlist is
+// configured; otherwise the CORS middleware has already answered
 func handleCORS(w http.ResponseWriter) {
+	if len(allowedOrigins) > 0 {
+		return
+	}
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Origin, Accept")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Origin, Accept, "+settings.RequestIDHeader)
 }
 
 // handleVideoUpload streams the uploaded file to S3 under `<sessionID>/<filename>`
@@ -81,172 +150,786 @@ func handleVideoUpload(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing sessionID", http.StatusBadRequest)
 		return
 	}
+	logger := settings.Logger(r.Context()).With("session_id", sessionID)
 
-	// enforce max upload size
-	r.Body = http.MaxBytesReader(w, r.Body, MAX_UPLOAD_SIZE)
-	if err := r.ParseMultipartForm(MAX_UPLOAD_SIZE); err != nil {
-		http.Error(w, "File too large", http.StatusBadRequest)
+	opts, err := parseUploadOptions(r.URL.Query().Get("format"), r.URL.Query().Get("chunkDuration"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	file, header, err := r.FormFile("video")
+	// enforce max upload size
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+	// everything for this upload lives under tmpDir until it's in S3
+	tmpDir, err := os.MkdirTemp("", "videosync-"+sessionID+"-")
 	if err != nil {
-		http.Error(w, "Missing 'video' form field", http.StatusBadRequest)
+		http.Error(w, "could not make temp dir", http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
+	defer os.RemoveAll(tmpDir)
 
-	// 1) Save the incoming file to disk
-	tmpDir := filepath.Join("tmp", sessionID)
-	if err := os.MkdirAll(tmpDir, 0755); err != nil {
-		http.Error(w, "could not make temp dir", http.StatusInternalServerError)
+	publishStatus(sessionID, UploadStatus{Stage: "receiving"})
+
+	// 1) Stream the incoming file to disk without buffering it in memory
+	srcPath, filename, err := saveUpload(r, tmpDir)
+	if err != nil {
+		logger.Error("saving upload", "error", err)
+		publishStatus(sessionID, UploadStatus{Stage: "failed"})
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
 		return
 	}
-	srcPath := filepath.Join(tmpDir, header.Filename)
-	dst, err := os.Create(srcPath)
+
+	// Transcoding keeps going if the client gives up waiting, progress is
+	// available from the status endpoint
+	urls, err := processVideo(logger, sessionID, srcPath, filename, tmpDir, opts)
 	if err != nil {
-		http.Error(w, "could not save upload", http.StatusInternalServerError)
+		var uerr *uploadError
+		if errors.As(err, &uerr) {
+			http.Error(w, uerr.Message, uerr.Status)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
-	if _, err := io.Copy(dst, file); err != nil {
-		dst.Close()
-		http.Error(w, "copy error", http.StatusInternalServerError)
-		return
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	response := map[string]string{"sessionID": sessionID}
+	if urls.PlaylistURL != "" {
+		response["playlistURL"] = urls.PlaylistURL
+	}
+	if urls.DashURL != "" {
+		response["dashURL"] = urls.DashURL
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// uploadError is a processing failure with the HTTP status to report
+type uploadError struct {
+	Status  int
+	Message string
+}
+
+func (e *uploadError) Error() string { return e.Message }
+
+// playbackURLs are the manifests an upload produced, empty for formats that
+// weren't asked for
+type playbackURLs struct {
+	PlaylistURL string
+	DashURL     string
+}
+
+// uploadOptions are the packaging choices a client can make per upload
+type uploadOptions struct {
+	Formats       outputFormats
+	ChunkDuration int // segment length in seconds
+}
+
+// parseUploadOptions reads the format and chunkDuration parameters of an
+// upload, either may be empty for the default. The errors are client facing.
+func parseUploadOptions(format, chunkDuration string) (uploadOptions, error) {
+	opts := uploadOptions{ChunkDuration: DEFAULT_CHUNK_DURATION}
+	var err error
+	if opts.Formats, err = parseFormats(format); err != nil {
+		return opts, errors.New("invalid_format")
 	}
-	dst.Close()
+	if chunkDuration != "" {
+		opts.ChunkDuration, err = strconv.Atoi(chunkDuration)
+		if err != nil || opts.ChunkDuration < MIN_CHUNK_DURATION || opts.ChunkDuration > MAX_CHUNK_DURATION {
+			return opts, errors.New("invalid_chunk_duration")
+		}
+	}
+	return opts, nil
+}
+
+// processVideo transcodes the source at srcPath (a local file or a URL ffmpeg
+// can read) into HLS and/or DASH, uploads the output and records the
+// session's manifest and initial state. Scratch files go in tmpDir.
+func processVideo(logger *slog.Logger, sessionID, srcPath, filename, tmpDir string, opts uploadOptions) (urls playbackURLs, err error) {
+	formats := opts.Formats
+	// Tell status listeners about failures on any path below
+	start := time.Now()
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			uploadsProcessed.WithLabelValues("failed").Inc()
+			status := UploadStatus{Stage: "failed"}
+			var uerr *uploadError
+			if errors.As(err, &uerr) {
+				status.Error = uerr.Message
+			}
+			publishStatus(sessionID, status)
+			return
+		}
+		uploadsProcessed.WithLabelValues("succeeded").Inc()
+		uploadDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	// Reject anything ffmpeg won't make a video of before transcoding, the
+	// probe also gives clients the real duration
+	duration, hasAudio, err := probeVideo(srcPath)
+	if err != nil {
+		logger.Warn("rejecting upload", "error", err)
+		return urls, &uploadError{http.StatusBadRequest, "invalid_video"}
+	}
+	outputs := variantsFor(hasAudio)
 
 	// 2) Generate per-quality HLS outputs
 	hlsDir := filepath.Join(tmpDir, "hls")
 	if err := os.MkdirAll(hlsDir, 0755); err != nil {
-		http.Error(w, "could not make hls dir", http.StatusInternalServerError)
-		return
+		return urls, &uploadError{http.StatusInternalServerError, "could not make hls dir"}
 	}
 
-	// Define qualities in descending order
-	variants := []struct {
-		Name       string
-		Resolution string
-		Bandwidth  int
-	}{
-		{"720p", "1280x720", 2800000},
-		{"480p", "854x480", 1400000},
-		{"360p", "640x360", 800000},
+	// A missing poster only costs the landing page its image
+	hasPoster := true
+	posterPath := filepath.Join(hlsDir, POSTER_NAME)
+	if err := extractPoster(srcPath, posterPath, duration); err != nil {
+		logger.Error("extracting poster", "error", err)
+		os.Remove(posterPath)
+		hasPoster = false
 	}
 
-	for _, v := range variants {
-		qualityDir := filepath.Join(hlsDir, v.Name)
-		if err := os.MkdirAll(qualityDir, 0755); err != nil {
-			http.Error(w, "could not make quality dir", http.StatusInternalServerError)
-			return
+	publishStatus(sessionID, UploadStatus{Stage: "transcoding"})
+	if formats.HLS {
+		if err := transcodeVariants(ctx, sessionID, srcPath, hlsDir, duration, opts.ChunkDuration, outputs); err != nil {
+			logger.Error("transcoding", "error", err)
+			return urls, &uploadError{http.StatusInternalServerError, "transcode_failed"}
+		}
+		if err := verifyPlaylists(hlsDir, outputs); err != nil {
+			logger.Error("transcoding produced no playable output", "error", err)
+			return urls, &uploadError{http.StatusInternalServerError, "transcode_failed"}
 		}
-		playlist := filepath.Join(qualityDir, "playlist.m3u8")
-		segmentPattern := filepath.Join(qualityDir, "segment_%03d.ts")
 
-		// run ffmpeg for this quality
-		cmd := exec.Command("ffmpeg",
-			"-i", srcPath,
-			"-c:v", "libx264", "-b:v", fmt.Sprintf("%dk", v.Bandwidth/1000),
-			"-s", v.Resolution,
-			"-c:a", "aac",
-			"-hls_time", "5",
-			"-hls_list_size", "0",
-			"-hls_segment_filename", segmentPattern,
-			playlist,
-		)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			http.Error(w, "ffmpeg failed for "+v.Name+": "+err.Error(), http.StatusInternalServerError)
-			return
+		// 3) Write a master playlist referencing each quality
+		if err := writeMasterPlaylist(filepath.Join(hlsDir, "master.m3u8"), outputs); err != nil {
+			return urls, &uploadError{http.StatusInternalServerError, "could not create master playlist"}
+		}
+	}
+	if formats.DASH {
+		dashDir := filepath.Join(hlsDir, DASH_DIR)
+		if err := transcodeDASH(ctx, sessionID, srcPath, dashDir, duration, opts.ChunkDuration, outputs); err != nil {
+			logger.Error("transcoding DASH", "error", err)
+			return urls, &uploadError{http.StatusInternalServerError, "transcode_failed"}
 		}
+		if err := verifyDASH(dashDir); err != nil {
+			logger.Error("DASH output not playable", "error", err)
+			return urls, &uploadError{http.StatusInternalServerError, "transcode_failed"}
+		}
+	}
+
+	// 4) Upload every playlist, manifest and segment (and the poster)
+	publishStatus(sessionID, UploadStatus{Stage: "uploading"})
+	if err := uploadHLS(logger, sessionID, hlsDir); err != nil {
+		logger.Error("uploading HLS output", "error", err)
+		return urls, &uploadError{http.StatusInternalServerError, "failed uploading video"}
+	}
+
+	// ================================
+	// 4) persisted initial Redis state
+	// ================================
+	// build our initial playback state, playing from the start
+	initState := store.InitialState(time.Now())
+	initState.Paused = false
+	if live, err := sessionStore.SetState(ctx, sessionID, initState, REDIS_MSG_EXPIRY); err != nil {
+		logger.Error("setting initial redis state", "error", err)
+	} else if !live {
+		logger.Warn("session expired before its video was ready")
 	}
 
-	// 3) Write a master playlist referencing each quality
-	masterFile := filepath.Join(hlsDir, "master.m3u8")
-	mf, err := os.Create(masterFile)
+	// store the manifest so the streaming server can answer videoMetadata,
+	// keeping any subtitles uploaded while the video was processing
+	err = updateManifest(sessionID, func(manifest *VideoManifest) {
+		manifest.ChunkDuration = opts.ChunkDuration
+		manifest.ChunkCount = int(math.Ceil(duration / float64(opts.ChunkDuration)))
+		manifest.VideoDuration = duration
+		manifest.VideoFileType = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+		manifest.Qualities = formats.qualities(outputs)
+		manifest.Formats = formats.names()
+		manifest.DASH = ""
+		if formats.DASH {
+			manifest.DASH = "/dash/" + sessionID + "/" + DASH_MANIFEST_NAME
+		}
+		manifest.Poster = ""
+		if hasPoster {
+			manifest.Poster = "/hls/" + sessionID + "/" + POSTER_NAME
+		}
+	})
 	if err != nil {
-		http.Error(w, "could not create master playlist", http.StatusInternalServerError)
-		return
+		logger.Error("setting manifest", "error", err)
+	}
+
+	// ================================
+	// 5) respond with the playback URLs
+	// ================================
+	base := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s/", bucket, region, sessionID)
+	if formats.HLS {
+		urls.PlaylistURL = base + "master.m3u8"
+	}
+	if formats.DASH {
+		urls.DashURL = base + DASH_DIR + "/" + DASH_MANIFEST_NAME
 	}
-	defer mf.Close()
 
+	succeeded = true
+	publishStatus(sessionID, UploadStatus{Stage: "done", PlaylistURL: urls.PlaylistURL, DashURL: urls.DashURL})
+	return urls, nil
+}
+
+// writeMasterPlaylist writes the HLS master playlist listing each variant
+func writeMasterPlaylist(path string, outputs []hlsVariant) error {
+	mf, err := os.Create(path)
+	if err != nil {
+		return err
+	}
 	mf.WriteString("#EXTM3U\n")
-	for _, v := range variants {
+	for _, v := range outputs {
+		if v.audioOnly() {
+			mf.WriteString(fmt.Sprintf(
+				"#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"mp4a.40.2\"\n%s/playlist.m3u8\n",
+				v.Bandwidth, v.Name,
+			))
+			continue
+		}
 		mf.WriteString(fmt.Sprintf(
 			"#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%s\n%s/playlist.m3u8\n",
 			v.Bandwidth, v.Resolution, v.Name,
 		))
 	}
+	return mf.Close()
+}
 
-	// 4) Upload EVERY .m3u8 + .ts under hlsDir/*
-	masterPath := filepath.Join(hlsDir, "master.m3u8")
-	masterKey := filepath.Join(sessionID, "master.m3u8")
+// verifyPlaylists checks that every variant's playlist lists at least one
+// segment and that its segments were written
+func verifyPlaylists(hlsDir string, outputs []hlsVariant) error {
+	for _, v := range outputs {
+		qualityDir := filepath.Join(hlsDir, v.Name)
+		data, err := os.ReadFile(filepath.Join(qualityDir, "playlist.m3u8"))
+		if err != nil {
+			return fmt.Errorf("%s: %w", v.Name, err)
+		}
 
-	f, err := os.Open(masterPath)
-	if err != nil {
-		log.Printf("could not open master playlist: %v", err)
-	} else {
-		_, err = uploader.Upload(context.Background(), &s3.PutObjectInput{
-			Bucket:      &bucket,
-			Key:         &masterKey,
-			Body:        f,
-			ContentType: aws.String("application/vnd.apple.mpegurl"),
+		segments := 0
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			info, err := os.Stat(filepath.Join(qualityDir, filepath.Base(line)))
+			if err != nil || info.Size() == 0 {
+				return fmt.Errorf("%s: segment %s missing or empty", v.Name, line)
+			}
+			segments++
+		}
+		if segments == 0 {
+			return fmt.Errorf("%s: playlist has no segments", v.Name)
+		}
+	}
+	return nil
+}
+
+// updateManifest applies change to the session's manifest, creating it if
+// needed. The read-modify-write is retried if another upload changes the
+// manifest in between.
+func updateManifest(sessionID string, change func(*VideoManifest)) error {
+	key := store.Key(sessionID, store.Manifest)
+	apply := func(tx *redis.Tx) error {
+		var manifest VideoManifest
+		val, err := tx.Get(ctx, key).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil {
+			if err := json.Unmarshal([]byte(val), &manifest); err != nil {
+				return err
+			}
+		}
+		change(&manifest)
+		manifestBytes, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+
+		// Keep the expiry the session's other keys have
+		ttl, err := tx.PTTL(ctx, key).Result()
+		if err != nil || ttl <= 0 {
+			ttl = REDIS_MSG_EXPIRY
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, manifestBytes, ttl)
+			return nil
 		})
-		f.Close()
+		return err
+	}
+
+	for attempt := 0; attempt < MANIFEST_UPDATE_RETRIES; attempt++ {
+		err := rdb.Watch(ctx, apply, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return errors.New("manifest kept changing")
+}
+
+// extractPoster saves a JPEG of the frame at POSTER_POSITION of the video to
+// outPath, using the first frame when the position can't be reached
+func extractPoster(srcPath, outPath string, duration float64) error {
+	grab := func(offset float64) error {
+		out, err := exec.CommandContext(ctx, "ffmpeg",
+			"-ss", strconv.FormatFloat(offset, 'f', 3, 64),
+			"-i", srcPath,
+			"-frames:v", "1",
+			"-q:v", "3",
+			"-y", outPath,
+		).CombinedOutput()
 		if err != nil {
-			log.Printf("failed uploading master playlist: %v", err)
+			return fmt.Errorf("%v: %s", err, out)
+		}
+		// Seeking past the last frame succeeds without writing anything
+		if info, err := os.Stat(outPath); err != nil || info.Size() == 0 {
+			return errors.New("no frame at " + strconv.FormatFloat(offset, 'f', 3, 64) + "s")
 		}
+		return nil
 	}
 
-	files, _ := filepath.Glob(filepath.Join(hlsDir, "*", "*"))
-	for _, path := range files {
-		key := filepath.Join(sessionID, filepath.Base(filepath.Dir(path)), filepath.Base(path))
-		f, err := os.Open(path)
+	offset := duration * POSTER_POSITION
+	if offset > 0 {
+		if err := grab(offset); err == nil {
+			return nil
+		}
+	}
+	return grab(0)
+}
+
+// transcodeVariants runs ffmpeg for every given variant, at most
+// transcodeWorkers at a time. The first failure cancels the remaining runs
+// and the outputs of failed variants are removed.
+func transcodeVariants(parent context.Context, sessionID, srcPath, hlsDir string, duration float64, chunkDuration int, outputs []hlsVariant) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, transcodeWorkers)
+		errs = make([]error, len(outputs))
+	)
+	for i, v := range outputs {
+		wg.Add(1)
+		go func(i int, v hlsVariant) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+
+			progress := func(percent int) {
+				publishStatus(sessionID, UploadStatus{Stage: "transcoding", Variant: v.Name, Percent: percent})
+			}
+			timer := prometheus.NewTimer(transcodeDuration.WithLabelValues(v.Name))
+			err := transcodeVariant(ctx, srcPath, hlsDir, v, duration, chunkDuration, progress)
+			timer.ObserveDuration()
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %w", v.Name, err)
+				os.RemoveAll(filepath.Join(hlsDir, v.Name))
+				cancel()
+			}
+		}(i, v)
+	}
+	wg.Wait()
+
+	// Report the variant that actually failed rather than a cancellation
+	var firstErr error
+	for _, err := range errs {
+		if err == nil || errors.Is(err, context.Canceled) {
+			continue
+		}
+		firstErr = err
+		break
+	}
+	if firstErr == nil && parent.Err() != nil {
+		firstErr = parent.Err()
+	}
+	return firstErr
+}
+
+// transcodeVariant runs ffmpeg for a single quality into hlsDir/{name}, in
+// segments of chunkDuration seconds
+func transcodeVariant(ctx context.Context, srcPath, hlsDir string, v hlsVariant, duration float64, chunkDuration int, progress func(int)) error {
+	qualityDir := filepath.Join(hlsDir, v.Name)
+	if err := os.MkdirAll(qualityDir, 0755); err != nil {
+		return err
+	}
+	playlist := filepath.Join(qualityDir, "playlist.m3u8")
+	segmentPattern := filepath.Join(qualityDir, "segment_%03d.ts")
+
+	args := []string{"-i", srcPath}
+	if v.audioOnly() {
+		args = append(args, "-vn", "-c:a", "aac", "-b:a", fmt.Sprintf("%dk", v.Bandwidth/1000))
+	} else {
+		args = append(args,
+			"-c:v", "libx264", "-b:v", fmt.Sprintf("%dk", v.Bandwidth/1000),
+			"-s", v.Resolution,
+			"-c:a", "aac",
+		)
+	}
+	args = append(args,
+		"-hls_time", strconv.Itoa(chunkDuration),
+		"-hls_list_size", "0",
+		"-hls_segment_filename", segmentPattern,
+		playlist,
+	)
+	return runFFmpeg(ctx, args, duration, progress)
+}
+
+// runFFmpeg runs ffmpeg with args, reporting whole-percent progress of a
+// source of the given duration parsed from ffmpeg's -progress output
+func runFFmpeg(ctx context.Context, args []string, duration float64, progress func(int)) error {
+	args = append([]string{"-progress", "pipe:1", "-nostats"}, args...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	stderr := &tailBuffer{max: FFMPEG_STDERR_TAIL}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// -progress writes key=value lines, out_time_us is the transcoded position
+	last := -1
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+
+		percent := -1
+		switch key {
+		case "out_time_us":
+			us, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || duration <= 0 {
+				continue
+			}
+			percent = int(float64(us) / (duration * 1e6) * 100)
+			percent = min(max(percent, 0), 99)
+		case "progress":
+			if value == "end" {
+				percent = 100
+			}
+		}
+		if percent > last {
+			last = percent
+			progress(percent)
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, bytes.TrimSpace(stderr.buf))
+	}
+	return nil
+}
+
+// tailBuffer keeps the last max bytes written to it
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if over := len(b.buf) - b.max; over > 0 {
+		b.buf = append(b.buf[:0], b.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+// UploadStatus is a progress event for an upload, published on
+// upload-status:{sessionID} and kept under session:{sessionID}:upload-status
+type UploadStatus struct {
+	Stage       string `json:"stage"` // receiving, transcoding, uploading, done or failed
+	Variant     string `json:"variant,omitempty"`
+	Percent     int    `json:"percent"`
+	PlaylistURL string `json:"playlistURL,omitempty"`
+	DashURL     string `json:"dashURL,omitempty"`
+	Error       string `json:"error,omitempty"` // why a failed upload failed, e.g. invalid_video
+}
+
+// publishStatus stores the latest status for late listeners and publishes it
+func publishStatus(sessionID string, status UploadStatus) {
+	payload, _ := json.Marshal(status)
+	if err := rdb.SetEX(ctx, store.Key(sessionID, store.UploadStatus), payload, REDIS_MSG_EXPIRY).Err(); err != nil {
+		slog.Error("storing upload status", "session_id", sessionID, "error", err)
+	}
+	if err := rdb.Publish(ctx, "upload-status:"+sessionID, payload).Err(); err != nil {
+		slog.Error("publishing upload status", "session_id", sessionID, "error", err)
+	}
+}
+
+// handleUploadStatus streams upload progress for a session as Server-Sent
+// Events until the upload is done or fails
+func handleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	handleCORS(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	sessionID := mux.Vars(r)["sessionID"]
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before reading the latest status so no event is missed
+	sub := rdb.Subscribe(r.Context(), "upload-status:"+sessionID)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// send writes one event, reporting whether the upload has finished
+	send := func(payload string) bool {
+		fmt.Fprintf(w, "data: %s\n\n", payload)
+		flusher.Flush()
+
+		var status UploadStatus
+		json.Unmarshal([]byte(payload), &status)
+		return status.Stage == "done" || status.Stage == "failed"
+	}
+
+	if latest, err := rdb.Get(r.Context(), store.Key(sessionID, store.UploadStatus)).Result(); err == nil {
+		if send(latest) {
+			return
+		}
+	}
+
+	messages := sub.Channel()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg, ok := <-messages:
+			if !ok || send(msg.Payload) {
+				return
+			}
+		}
+	}
+}
+
+// saveUpload streams the "video" part of the multipart body into a temp file
+// in dir, returning its path and the client supplied filename
+func saveUpload(r *http.Request, dir string) (string, string, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return "", "", fmt.Errorf("expected multipart form: %w", err)
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return "", "", errors.New("missing 'video' form field")
+		}
 		if err != nil {
-			log.Printf("open %s: %v", path, err)
+			return "", "", err
+		}
+		if part.FormName() != "video" {
+			part.Close()
 			continue
 		}
-		_, err = uploader.Upload(context.Background(), &s3.PutObjectInput{
-			Bucket:      &bucket,
-			Key:         &key,
-			Body:        f,
-			ContentType: aws.String(http.DetectContentType(readHeader(f))),
-		})
-		f.Close()
+		defer part.Close()
+
+		filename, err := sanitizeFilename(part)
+		if err != nil {
+			return "", "", err
+		}
+
+		dst, err := os.CreateTemp(dir, "source-*"+filepath.Ext(filename))
 		if err != nil {
-			log.Printf("upload %s: %v", key, err)
+			return "", "", err
 		}
+		defer dst.Close()
+
+		if _, err := io.Copy(dst, part); err != nil {
+			return "", "", err
+		}
+		return dst.Name(), filename, nil
 	}
+}
 
-	// ================================
-	// 4) persisted initial Redis state
-	// ================================
-	// build our initial playback state
-	initState := map[string]interface{}{
-		"paused":       false,
-		"currentTime":  0,
-		"playbackRate": 1,
-		"timestamp":    time.Now().UnixMilli(),
+// sanitizeFilename validates the client supplied filename of a part. Part.FileName
+// silently strips directories, so the raw Content-Disposition value is checked
+// to reject traversal attempts outright.
+func sanitizeFilename(part *multipart.Part) (string, error) {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return "", errors.New("invalid Content-Disposition")
 	}
-	stateBytes, _ := json.Marshal(initState)
-	stateKey := fmt.Sprintf("session:%s:state", sessionID)
-	if err := rdb.SetEX(ctx, stateKey, stateBytes, REDIS_MSG_EXPIRY).Err(); err != nil {
-		log.Printf("error setting initial redis state for %s: %v", sessionID, err)
+	return validateFilename(params["filename"])
+}
+
+// validateFilename rejects empty names and names with path components
+func validateFilename(raw string) (string, error) {
+	if raw == "" {
+		return "", errors.New("missing filename")
+	}
+	if strings.ContainsAny(raw, "/\\\x00") {
+		return "", errors.New("invalid filename")
 	}
 
-	// ================================
-	// 5) respond with playlistURL
-	// ================================
-	os.RemoveAll(tmpDir)
-	region := os.Getenv("AWS_REGION")
-	playlistURL := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s/master.m3u8",
-		bucket, region, sessionID)
+	name := filepath.Base(raw)
+	if name == "." || name == ".." || name != raw {
+		return "", errors.New("invalid filename")
+	}
+	return name, nil
+}
+
+// uploadHLS uploads every file under hlsDir (playlists, segments, the DASH
+// output and the poster) to S3, using up to s3Workers concurrent uploads
+func uploadHLS(logger *slog.Logger, sessionID, hlsDir string) error {
+	var files []string
+	err := filepath.WalkDir(hlsDir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, s3Workers)
+	)
+	for _, path := range files {
+		rel, err := filepath.Rel(hlsDir, path)
+		if err != nil {
+			return err
+		}
+		key := sessionID + "/" + filepath.ToSlash(rel)
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(path, key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := uploadFile(path, key); err != nil {
+				logger.Error("uploading file", "key", key, "error", err)
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(path, key)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// uploadFile uploads a single local file to S3 under key
+func uploadFile(path, key string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = uploader.Upload(context.Background(), &s3.PutObjectInput{
+		Bucket:      &bucket,
+		Key:         &key,
+		Body:        f,
+		ContentType: aws.String(contentTypeFor(f)),
+	})
+	return err
+}
+
+// contentTypeFor picks the content type of an HLS file from its extension,
+// sniffing anything unknown
+func contentTypeFor(f *os.File) string {
+	switch filepath.Ext(f.Name()) {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".ts":
+		return "video/MP2T"
+	case ".jpg":
+		return "image/jpeg"
+	case ".vtt":
+		return "text/vtt"
+	case ".mpd":
+		return "application/dash+xml"
+	case ".m4s":
+		return "video/iso.segment"
+	}
+	return http.DetectContentType(readHeader(f))
+}
+
+// requireLiveSession checks that sessionID names a live session, writing a
+// 400 or 404 if it doesn't
+func requireLiveSession(w http.ResponseWriter, sessionID string) bool {
+	if !validSessionKey(sessionID) {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return false
+	}
+	live, err := sessionStore.Exists(ctx, sessionID)
+	if err != nil {
+		http.Error(w, "could not read session", http.StatusInternalServerError)
+		return false
+	}
+	if !live {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// validSessionKey reports whether key is a session ID in canonical UUID form
+func validSessionKey(key string) bool {
+	id, err := uuid.Parse(key)
+	return err == nil && id.String() == key
+}
+
+// handleHealthz checks Redis and S3 access, responding 503 if either fails
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	checkCtx, cancel := context.WithTimeout(r.Context(), HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+
+	status := "healthy"
+	code := http.StatusOK
+	dependencies := map[string]string{"redis": "ok", "s3": "ok"}
+	if err := rdb.Ping(checkCtx).Err(); err != nil {
+		settings.Logger(r.Context()).Warn("health check: redis unreachable", "error", err)
+		status, code = "unhealthy", http.StatusServiceUnavailable
+		dependencies["redis"] = err.Error()
+	}
+	if _, err := s3Client.HeadBucket(checkCtx, &s3.HeadBucketInput{Bucket: &bucket}); err != nil {
+		settings.Logger(r.Context()).Warn("health check: bucket unreachable", "bucket", bucket, "error", err)
+		status, code = "unhealthy", http.StatusServiceUnavailable
+		dependencies["s3"] = err.Error()
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{
-		"sessionID":   sessionID,
-		"playlistURL": playlistURL,
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":       status,
+		"dependencies": dependencies,
 	})
 }
 
@@ -259,26 +942,179 @@ func readHeader(f *os.File) []byte {
 	return buf[:n]
 }
 
+// probeVideo checks with ffprobe that a source has a video stream and a
+// positive duration, returning the duration in seconds and whether the source
+// has sound
+func probeVideo(path string) (float64, bool, error) {
+	out, err := exec.Command("ffprobe",
+		"-v", "error",
+		"-show_entries", "stream=codec_type:format=duration",
+		"-of", "json",
+		path,
+	).Output()
+	if err != nil {
+		return 0, false, fmt.Errorf("ffprobe: %w", err)
+	}
+
+	var probe struct {
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return 0, false, fmt.Errorf("ffprobe output: %w", err)
+	}
+
+	hasVideo, hasAudio := false, false
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "video":
+			hasVideo = true
+		case "audio":
+			hasAudio = true
+		}
+	}
+	if !hasVideo {
+		return 0, false, errors.New("no video stream")
+	}
+
+	duration, err := strconv.ParseFloat(probe.Format.Duration, 64)
+	if err != nil || !(duration > 0) || math.IsInf(duration, 0) {
+		return 0, false, fmt.Errorf("no usable duration %q", probe.Format.Duration)
+	}
+	return duration, hasAudio, nil
+}
+
 func main() {
+	settings.SetupLogging("upload")
+	cfg := settings.Register()
 	port := flag.String("port", "8082", "port for upload server")
+	maxUploadMB := flag.Int("max-upload-size-mb", settings.EnvInt("MAX_UPLOAD_SIZE_MB", DEFAULT_MAX_UPLOAD_MB),
+		"Largest video accepted in one request, in MB (env MAX_UPLOAD_SIZE_MB)")
+	flag.IntVar(&s3Workers, "s3-upload-workers", settings.EnvInt("S3_UPLOAD_WORKERS", s3Workers),
+		"Files of one upload sent to S3 at once (env S3_UPLOAD_WORKERS)")
+	flag.IntVar(&transcodeWorkers, "transcode-workers", settings.EnvInt("TRANSCODE_WORKERS", transcodeWorkers),
+		"Qualities of one upload transcoded at once (env TRANSCODE_WORKERS)")
+	flag.DurationVar(&cleanupInterval, "cleanup-interval", settings.EnvDuration("CLEANUP_INTERVAL", cleanupInterval),
+		"Time between sweeps for the objects of expired sessions (env CLEANUP_INTERVAL)")
+	flag.DurationVar(&cleanupGrace, "cleanup-grace-period", settings.EnvDuration("CLEANUP_GRACE_PERIOD", cleanupGrace),
+		"How long a session must be gone before its objects are swept (env CLEANUP_GRACE_PERIOD)")
 	flag.Parse()
+	if err := cfg.Validate(true); err != nil {
+		log.Fatal(err)
+	}
+	if *maxUploadMB <= 0 {
+		log.Fatalf("max upload size must be positive, got %d MB", *maxUploadMB)
+	}
+	maxUploadSize = int64(*maxUploadMB) << 20
+	if s3Workers <= 0 {
+		log.Fatalf("S3 upload workers must be positive, got %d", s3Workers)
+	}
+	if transcodeWorkers <= 0 {
+		log.Fatalf("transcode workers must be positive, got %d", transcodeWorkers)
+	}
+	if cleanupInterval <= 0 {
+		log.Fatalf("cleanup interval must be positive, got %v", cleanupInterval)
+	}
+	if cleanupGrace < 0 {
+		log.Fatalf("cleanup grace period can't be negative, got %v", cleanupGrace)
+	}
+
+	allowedOrigins = cfg.AllowedOrigins
+
+	// The same bucket and region are used for uploads and the returned URLs
+	bucket = cfg.S3Bucket
+	region = cfg.AWSRegion
+
+	// load AWS SDK config
+	awsCfg, err := cfg.LoadAWSConfig(ctx)
+	if err != nil {
+		log.Fatalf("unable to load AWS SDK config: %v", err)
+	}
+
+	// create a high-level uploader
+	s3Client = s3.NewFromConfig(awsCfg)
+	presignClient = s3.NewPresignClient(s3Client)
+	uploader = manager.NewUploader(s3Client)
+
+	// initialize Redis client
+	rdb = cfg.NewRedisClient()
+	sessionStore = store.NewSessionStore(rdb)
+	settings.CountRedisErrors(rdb, redisErrors)
+
+	// remove the S3 objects of ended and expired sessions
+	go listenForEndedSessions()
+	go sweepExpiredSessions()
 
 	r := mux.NewRouter()
+	r.Use(settings.LogRequests)
 
 	// upload endpoint
 	r.HandleFunc("/api/video/{sessionID}", handleVideoUpload).
 		Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/api/video/{sessionID}/status", handleUploadStatus).
+		Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/api/video/{sessionID}/subtitles", handleSubtitleUpload).
+		Methods(http.MethodPost, http.MethodOptions)
+
+	// chunked upload endpoints
+	r.HandleFunc("/api/video/{sessionID}/init", handleChunkedInit).
+		Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/api/video/{sessionID}/{uploadID}/chunk/{n}", handleChunkUpload).
+		Methods(http.MethodPut, http.MethodOptions)
+	r.HandleFunc("/api/video/{sessionID}/{uploadID}/complete", handleChunkedComplete).
+		Methods(http.MethodPost, http.MethodOptions)
+
+	// health check, verifies Redis and S3 access
+	r.HandleFunc("/healthz", handleHealthz).Methods(http.MethodGet)
+	r.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
 
 	// serve your upload_video.html + JS
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("../frontend/pages")))
 
 	// wrap in CORS
 	cors := handlers.CORS(
-		handlers.AllowedOrigins([]string{"*"}),
-		handlers.AllowedMethods([]string{"GET", "POST", "OPTIONS"}),
-		handlers.AllowedHeaders([]string{"Content-Type", "Origin", "Accept"}),
+		handlers.AllowedOrigins(cfg.CORSOrigins()),
+		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "OPTIONS"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Origin", "Accept", settings.RequestIDHeader}),
+		handlers.ExposedHeaders([]string{settings.RequestIDHeader}),
 	)(r)
 
-	log.Printf("Upload server running on port %s", *port)
-	log.Fatal(http.ListenAndServe(":"+*port, cors))
+	// Stop on SIGINT/SIGTERM, letting running uploads finish
+	stopCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Addr: ":" + *port, Handler: settings.RequestID(cors)}
+	go func() {
+		slog.Info("upload server running", "port", *port)
+		if err := cfg.ListenAndServe(srv); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-stopCtx.Done()
+	slog.Info("shutting down, waiting for uploads to finish")
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("shutting down", "error", err)
+	}
+
+	// Chunked uploads are transcoded after their request has returned
+	jobsDone := make(chan struct{})
+	go func() {
+		backgroundJobs.Wait()
+		close(jobsDone)
+	}()
+	select {
+	case <-jobsDone:
+	case <-shutdownCtx.Done():
+		slog.Warn("gave up waiting for background transcodes")
+	}
+	rdb.Close()
+	slog.Info("upload server stopped")
 }
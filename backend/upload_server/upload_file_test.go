@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// quoteFilename quotes a Content-Disposition parameter, escaping only what
+// a quoted-string must so control bytes reach the server as they are
+func quoteFilename(name string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+}
+
+func TestSaveUploadFilenames(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		want     string // "" when the upload must be rejected
+	}{
+		{"plain", "movie.mp4", "movie.mp4"},
+		{"spaces", "my movie.mp4", "my movie.mp4"},
+		{"parent directory", "../movie.mp4", ""},
+		{"nested traversal", "videos/../../movie.mp4", ""},
+		{"absolute path", "/etc/passwd", ""},
+		{"windows absolute path", `C:\Users\movie.mp4`, ""},
+		{"slash separator", "videos/movie.mp4", ""},
+		{"backslash separator", `videos\movie.mp4`, ""},
+		{"nul byte", "movie.mp4\x00.sh", ""},
+		{"dot dot", "..", ""},
+		{"dot", ".", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			w := multipart.NewWriter(&body)
+			header := make(textproto.MIMEHeader)
+			header.Set("Content-Disposition", `form-data; name="video"; filename=`+quoteFilename(tt.filename))
+			part, err := w.CreatePart(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			part.Write([]byte("not really a video"))
+			w.Close()
+
+			req := httptest.NewRequest("POST", "/api/video/s", &body)
+			req.Header.Set("Content-Type", w.FormDataContentType())
+			dir := t.TempDir()
+
+			path, filename, err := saveUpload(req, dir)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("accepted %q as %q", tt.filename, filename)
+				}
+				if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+					t.Errorf("rejected upload left %d files behind", len(entries))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rejected %q: %v", tt.filename, err)
+			}
+			if filename != tt.want {
+				t.Errorf("filename = %q, want %q", filename, tt.want)
+			}
+			if filepath.Dir(path) != dir {
+				t.Errorf("saved to %s, outside %s", path, dir)
+			}
+		})
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	b := &tailBuffer{max: 8}
+	for _, s := range []string{"abc", "defgh", "ijklmnopqrst", "uv"} {
+		if n, err := b.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	if got := string(b.buf); got != "opqrstuv" {
+		t.Errorf("kept %q, want the last 8 bytes", got)
+	}
+}
+
+func TestManifestQualities(t *testing.T) {
+	outputs := variants[:2]
+	tests := []struct {
+		name    string
+		formats outputFormats
+		want    string
+	}{
+		{"hls", outputFormats{HLS: true}, "720p,480p"},
+		{"both", outputFormats{HLS: true, DASH: true}, "720p,480p"},
+		{"dash only", outputFormats{DASH: true}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qualities := tt.formats.qualities(outputs)
+			if qualities == nil {
+				t.Fatal("qualities is nil, want a list")
+			}
+			if got := strings.Join(qualities, ","); got != tt.want {
+				t.Errorf("qualities = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
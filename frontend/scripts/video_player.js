@@ -3,6 +3,11 @@ let STREAMING_URL = ""
 let isHost = false;
 let ws = null;
 let latency = 0;
+let joinToken = null;
+let participantId = null;
+let connectionReplaced = false; // a newer tab took over, don't reconnect
+let serverMoving = false; // our streaming server told us to move, reconnect right away
+const RECONNECT_DELAY = 3000;
 
 const videoElement = document.getElementById('videoPlayer');
 const urlParams = new URLSearchParams(window.location.search);
@@ -13,6 +18,18 @@ let chunkCount = 0;
 let videoDuration = 0;
 let mediaSourceInitialized = false;
 
+// Reactions the streaming server accepts, by the name sent over the socket
+const REACTIONS = {
+    heart: '❤️',
+    laugh: '😂',
+    clap: '👏',
+    wow: '😮',
+    sad: '😢',
+    fire: '🔥',
+    thumbs: '👍',
+    party: '🎉',
+};
+
 // Create new session
 async function createNewSession() {
     try {
@@ -41,40 +58,65 @@ async function createNewSession() {
     }
 }
 
-// Join session
-async function initializeSession() {
-    try {
-        console.log('Initializing session with key:', sessionKey);
-
-        const urlHostToken = urlParams.get('hostToken');
-        const storedHostToken = sessionStorage.getItem('hostToken');
-        const hostToken = urlHostToken || storedHostToken;
+// Validate the session with the main server, which also picks its streaming
+// server. Returns the response, or null when the session can't be joined.
+async function validateSession() {
+    const urlHostToken = urlParams.get('hostToken');
+    const storedHostToken = sessionStorage.getItem('hostToken');
+    const hostToken = urlHostToken || storedHostToken;
 
-        const validateUrl = `${BACKEND_URL}/api/sessions/${encodeURIComponent(sessionKey)}/validate`;
-        const urlWithParams = hostToken ? `${validateUrl}?hostToken=${encodeURIComponent(hostToken)}` : validateUrl;
+    const validateUrl = `${BACKEND_URL}/api/sessions/${encodeURIComponent(sessionKey)}/validate`;
+    const urlWithParams = hostToken ? `${validateUrl}?hostToken=${encodeURIComponent(hostToken)}` : validateUrl;
 
-        console.log('Sending validation request to:', urlWithParams);
-        const response = await fetch(urlWithParams);
+    console.log('Sending validation request to:', urlWithParams);
+    const password = sessionStorage.getItem(`password:${sessionKey}`);
+    const response = await fetch(urlWithParams, {
+        headers: password ? { 'X-Session-Password': password } : {}
+    });
 
-        if (!response.ok) {
-            throw new Error(`HTTP error! status: ${response.status}`);
+    // Private session, ask for the password and try again
+    if (response.status === 401 || response.status === 403) {
+        const entered = prompt(response.status === 401 ? 'This session needs a password' : 'Wrong password, try again');
+        if (entered === null) {
+            setStatus('Password required', true);
+            return null;
         }
+        sessionStorage.setItem(`password:${sessionKey}`, entered);
+        return validateSession();
+    }
 
-        const data = await response.json();
-        console.log('Session validation response:', data);
+    if (!response.ok) {
+        throw new Error(`HTTP error! status: ${response.status}`);
+    }
 
-        if (!data.valid) {
-            setStatus('Invalid session key', true);
-            return;
-        }
+    const data = await response.json();
+    console.log('Session validation response:', data);
 
-        isHost = data.isHost;
-        console.log('User role:', isHost ? 'Host' : 'Participant');
+    if (!data.valid) {
+        setStatus('Invalid session key', true);
+        return null;
+    }
+
+    isHost = data.isHost;
+    joinToken = data.joinToken || null;
+    console.log('User role:', isHost ? 'Host' : 'Participant');
+
+    if (isHost && hostToken && !urlHostToken) {
+        const newUrl = new URL(window.location.href);
+        newUrl.searchParams.set('hostToken', hostToken);
+        window.history.replaceState({}, '', newUrl);
+    }
+    return data;
+}
 
-        if (isHost && hostToken && !urlHostToken) {
-            const newUrl = new URL(window.location.href);
-            newUrl.searchParams.set('hostToken', hostToken);
-            window.history.replaceState({}, '', newUrl);
+// Join session
+async function initializeSession() {
+    try {
+        console.log('Initializing session with key:', sessionKey);
+
+        const data = await validateSession();
+        if (!data) {
+            return;
         }
 
         // After receiving streaming URL
@@ -108,6 +150,7 @@ async function initializeSession() {
         document.getElementById('userRole').textContent = isHost ? 'Host' : 'Participant';
         updateControls();
         attachCustomControlListeners();
+        attachReactionListeners();
 
         videoElement.addEventListener('error', (e) => {
             console.error('Video error:', videoElement.error);
@@ -140,7 +183,12 @@ function connectWebSocket(streamingUrl) {
     wsUrl.searchParams.set('sessionID', sessionKey);
     if (isHost) {
         wsUrl.searchParams.set('isHost', 'true');
+        wsUrl.searchParams.set('hostToken', urlParams.get('hostToken') || sessionStorage.getItem('hostToken') || '');
     }
+    if (joinToken) {
+        wsUrl.searchParams.set('joinToken', joinToken);
+    }
+    wsUrl.searchParams.set('clientId', getClientId());
 
     ws = new WebSocket(wsUrl);
 
@@ -157,8 +205,15 @@ function connectWebSocket(streamingUrl) {
 
     ws.onclose = () => {
         console.log('WebSocket disconnected');
+        if (connectionReplaced) {
+            setStatus('Session opened in another tab', true);
+            return;
+        }
         setStatus('Connection lost - attempting to reconnect...', true);
-        setTimeout(() => connectWebSocket(streamingUrl), 3000);
+        // Validate again rather than retrying the old URL, the server may be gone
+        const delay = serverMoving ? 0 : RECONNECT_DELAY;
+        serverMoving = false;
+        setTimeout(reconnectSession, delay);
     };
 
     ws.onerror = (error) => {
@@ -167,6 +222,31 @@ function connectWebSocket(streamingUrl) {
     };
 }
 
+// Reconnect to whichever streaming server the main server now assigns the
+// session, moving the player over too if it changed
+async function reconnectSession() {
+    try {
+        const data = await validateSession();
+        if (!data) {
+            return;
+        }
+        if (data.streaming_url !== STREAMING_URL) {
+            STREAMING_URL = data.streaming_url;
+            const player = videojs('videoPlayer');
+            const position = player.currentTime();
+            player.src({
+                src: `${STREAMING_URL}/hls/${sessionKey}/master.m3u8`,
+                type: 'application/vnd.apple.mpegurl'
+            });
+            player.one('loadedmetadata', () => player.currentTime(position));
+        }
+        connectWebSocket(STREAMING_URL);
+    } catch (error) {
+        console.error('Reconnect failed:', error);
+        setTimeout(reconnectSession, RECONNECT_DELAY);
+    }
+}
+
 function handleStreamingServerMessage(data) {
     switch (data.type) {
         case 'init':
@@ -175,15 +255,53 @@ function handleStreamingServerMessage(data) {
         case 'stateUpdate':
             handleStateUpdate(data);
             break;
+        case 'seek':
+            handleSeek(data);
+            break;
+        case 'rateChange':
+            handleRateChange(data);
+            break;
         case 'videoMetadata':
             handleVideoMetadata(data);
             break;
         case 'heartbeat':
             handleHeartbeat(data);
             break;
+        case 'participants':
+            participantId = data.participantId;
+            break;
+        case 'hostChanged':
+            handleHostChanged(data);
+            break;
+        case 'bufferingStatus':
+            handleBufferingStatus(data);
+            break;
+        case 'connectionReplaced':
+            connectionReplaced = true;
+            break;
+        case 'serverReassign':
+        case 'serverDraining':
+            // Our server stopped heartbeating or is shutting down and has
+            // deregistered, it closes the socket next
+            serverMoving = true;
+            break;
+        case 'reaction':
+            showReaction(data);
+            break;
     }
 }
 
+// Stable ID of this browser, sent on every connection so the streaming server
+// can close our stale sockets
+function getClientId() {
+    let clientId = localStorage.getItem('clientId');
+    if (!clientId) {
+        clientId = crypto.randomUUID();
+        localStorage.setItem('clientId', clientId);
+    }
+    return clientId;
+}
+
 function handleInitialization(data) {
     isHost = data.isHost;
     document.getElementById('userRole').textContent = isHost ? 'Admin' : 'Participant';
@@ -210,7 +328,8 @@ function handleStateUpdate(data) {
     latency = localTime - serverTime;
 
     const currentTime = videoElement.currentTime;
-    const targetTime = data.state.currentTime + (latency / 1000);
+    const elapsed = data.state.paused ? 0 : (latency / 1000) * data.state.playbackRate;
+    const targetTime = data.state.currentTime + elapsed;
 
     if (Math.abs(currentTime - targetTime) > 0.5) {
         videoElement.currentTime = targetTime;
@@ -223,6 +342,42 @@ function handleStateUpdate(data) {
     videoElement.playbackRate = data.state.playbackRate;
 }
 
+// The host jumped, go straight to the new position instead of correcting
+function handleSeek(data) {
+    const latency = Date.now() - data.servertime;
+    videoElement.currentTime = data.state.currentTime + (data.state.paused ? 0 : (latency / 1000) * data.state.playbackRate);
+    if (data.state.paused !== videoElement.paused) {
+        data.state.paused ? videoElement.pause() : videoElement.play();
+    }
+    videoElement.playbackRate = data.state.playbackRate;
+}
+
+// The host handed the session over, the old host token no longer works
+function handleHostChanged(data) {
+    const wasHost = isHost;
+    isHost = data.participantId !== '' && data.participantId === participantId;
+    if (wasHost && !isHost) {
+        sessionStorage.removeItem('hostToken');
+        const newUrl = new URL(window.location.href);
+        newUrl.searchParams.delete('hostToken');
+        window.history.replaceState({}, '', newUrl);
+    }
+    document.getElementById('userRole').textContent = isHost ? 'Host' : 'Participant';
+    updateControls();
+}
+
+// The host changed speed, keep playing and only correct a large drift
+function handleRateChange(data) {
+    videoElement.playbackRate = data.state.playbackRate;
+    if (data.state.paused) return;
+
+    const latency = Date.now() - data.servertime;
+    const targetTime = data.state.currentTime + (latency / 1000) * data.state.playbackRate;
+    if (Math.abs(videoElement.currentTime - targetTime) > 1) {
+        videoElement.currentTime = targetTime;
+    }
+}
+
 function handleHeartbeat() {
     ws.send(JSON.stringify({ type: 'heartbeatAck' }));
 }
@@ -232,7 +387,7 @@ function sendPlayerState(type) {
     if (!isHost || !ws || ws.readyState !== WebSocket.OPEN) return;
 
     const video_state = {
-        type: 'stateUpdate',
+        type: type === 'seek' ? 'seek' : 'stateUpdate',
         state: {
             paused: videoElement.paused,
             currentTime: videoElement.currentTime,
@@ -283,6 +438,36 @@ function attachCustomControlListeners() {
     });
 }
 
+// Reaction buttons, anyone can react
+function attachReactionListeners() {
+    const bar = document.getElementById('reactionBar');
+    for (const [name, emoji] of Object.entries(REACTIONS)) {
+        const button = document.createElement('button');
+        button.className = 'reaction-button';
+        button.textContent = emoji;
+        button.title = name;
+        button.addEventListener('click', () => {
+            if (ws && ws.readyState === WebSocket.OPEN) {
+                ws.send(JSON.stringify({ type: 'reaction', reaction: name }));
+            }
+        });
+        bar.appendChild(button);
+    }
+}
+
+// Float a reaction up over the video
+function showReaction(data) {
+    const emoji = REACTIONS[data.reaction];
+    if (!emoji) return;
+    const element = document.createElement('span');
+    element.className = 'floating-reaction';
+    element.textContent = emoji;
+    element.title = data.name;
+    element.style.left = `${10 + Math.random() * 80}%`;
+    element.addEventListener('animationend', () => element.remove());
+    document.getElementById('reactionOverlay').appendChild(element);
+}
+
 // Status message display
 function setStatus(message, isError) {
     const statusElement = document.getElementById('statusMessage');
@@ -298,6 +483,30 @@ function setStatus(message, isError) {
 videoElement.addEventListener('play', () => sendPlayerState('play'));
 videoElement.addEventListener('pause', () => sendPlayerState('pause'));
 videoElement.addEventListener('seeked', () => sendPlayerState('seek'));
+videoElement.addEventListener('ratechange', () => sendPlayerState('ratechange'));
+
+// Tell the server when playback stalls and resumes, so the host can wait
+videoElement.addEventListener('waiting', () => sendBufferingReport(true));
+videoElement.addEventListener('playing', () => sendBufferingReport(false));
+
+function sendBufferingReport(stalled) {
+    if (isHost || !ws || ws.readyState !== WebSocket.OPEN) return;
+
+    let bufferLevel = 0;
+    const buffered = videoElement.buffered;
+    for (let i = 0; i < buffered.length; i++) {
+        if (buffered.start(i) <= videoElement.currentTime && videoElement.currentTime <= buffered.end(i)) {
+            bufferLevel = buffered.end(i) - videoElement.currentTime;
+        }
+    }
+    ws.send(JSON.stringify({ type: 'bufferingReport', stalled, bufferLevel }));
+}
+
+function handleBufferingStatus(data) {
+    if (data.stalledViewers > 0) {
+        setStatus(`${data.stalledViewers} of ${data.viewers} viewers buffering`, false);
+    }
+}
 
 videoElement.addEventListener('timeupdate', () => {
     document.getElementById('currentTime').textContent = formatTime(videoElement.currentTime);